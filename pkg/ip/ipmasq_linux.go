@@ -21,56 +21,118 @@ import (
 	"github.com/coreos/go-iptables/iptables"
 )
 
+// IPMasqOptions changes which traffic SetupIPMasqWithOptions masquerades,
+// and how.
+type IPMasqOptions struct {
+	// NonMasqueradeCIDRs are reached without masquerading, besides the
+	// network itself and multicast
+	NonMasqueradeCIDRs []*net.IPNet
+	// SNATIP is the source address of masqueraded traffic of its family.
+	// Without it, the address of the outgoing interface is used.
+	SNATIP net.IP
+}
+
+// ParseIPMasqOptions parses the nonMasqueradeCIDRs and snatIP options of
+// a network configuration
+func ParseIPMasqOptions(nonMasqueradeCIDRs []string, snatIP string) (*IPMasqOptions, error) {
+	opts := &IPMasqOptions{}
+	for _, cidr := range nonMasqueradeCIDRs {
+		_, ipn, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nonMasqueradeCIDRs entry %q: %v", cidr, err)
+		}
+		opts.NonMasqueradeCIDRs = append(opts.NonMasqueradeCIDRs, ipn)
+	}
+	if snatIP != "" {
+		opts.SNATIP = net.ParseIP(snatIP)
+		if opts.SNATIP == nil {
+			return nil, fmt.Errorf("invalid snatIP %q", snatIP)
+		}
+	}
+	return opts, nil
+}
+
 // SetupIPMasq installs iptables rules to masquerade traffic
 // coming from ipn and going outside of it
 func SetupIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	return SetupIPMasqWithOptions(ipn, chain, comment, nil)
+}
+
+// SetupIPMasqWithOptions installs iptables rules to masquerade traffic
+// coming from ipn and going outside of it, as changed by opts
+func SetupIPMasqWithOptions(ipn *net.IPNet, chain string, comment string, opts *IPMasqOptions) error {
 	isV6 := ipn.IP.To4() == nil
 
 	var ipt *iptables.IPTables
 	var err error
-	var multicastNet string
 
 	if isV6 {
 		ipt, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
-		multicastNet = "ff00::/8"
 	} else {
 		ipt, err = iptables.NewWithProtocol(iptables.ProtocolIPv4)
-		multicastNet = "224.0.0.0/4"
 	}
 	if err != nil {
 		return fmt.Errorf("failed to locate iptables: %v", err)
 	}
 
-	// Create chain if doesn't exist
-	exists := false
+	if err := ensureNatChain(ipt, chain); err != nil {
+		return err
+	}
+
+	for _, rule := range ipMasqRules(ipn, opts) {
+		if err := ipt.AppendUnique("nat", chain, append(rule, "-m", "comment", "--comment", comment)...); err != nil {
+			return err
+		}
+	}
+
+	return ipt.AppendUnique("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment)
+}
+
+// ensureNatChain creates the chain in the nat table if it doesn't exist
+func ensureNatChain(ipt *iptables.IPTables, chain string) error {
 	chains, err := ipt.ListChains("nat")
 	if err != nil {
 		return fmt.Errorf("failed to list chains: %v", err)
 	}
 	for _, ch := range chains {
 		if ch == chain {
-			exists = true
-			break
+			return nil
 		}
 	}
-	if !exists {
-		if err = ipt.NewChain("nat", chain); err != nil {
-			return err
-		}
+	return ipt.NewChain("nat", chain)
+}
+
+// ipMasqRules returns the rules of the chain of ipn, without comments
+func ipMasqRules(ipn *net.IPNet, opts *IPMasqOptions) [][]string {
+	isV6 := ipn.IP.To4() == nil
+	if opts == nil {
+		opts = &IPMasqOptions{}
+	}
+
+	multicastNet := "224.0.0.0/4"
+	if isV6 {
+		multicastNet = "ff00::/8"
 	}
 
 	// Packets to this network should not be touched
-	if err := ipt.AppendUnique("nat", chain, "-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment); err != nil {
-		return err
+	rules := [][]string{{"-d", ipn.String(), "-j", "ACCEPT"}}
+
+	// Neither should packets to the other networks that can see the
+	// addresses of this one
+	for _, cidr := range opts.NonMasqueradeCIDRs {
+		if (cidr.IP.To4() == nil) == isV6 {
+			rules = append(rules, []string{"-d", cidr.String(), "-j", "ACCEPT"})
+		}
 	}
 
 	// Don't masquerade multicast - pods should be able to talk to other pods
 	// on the local network via multicast.
-	if err := ipt.AppendUnique("nat", chain, "!", "-d", multicastNet, "-j", "MASQUERADE", "-m", "comment", "--comment", comment); err != nil {
-		return err
+	if opts.SNATIP != nil && (opts.SNATIP.To4() == nil) == isV6 {
+		rules = append(rules, []string{"!", "-d", multicastNet, "-j", "SNAT", "--to-source", opts.SNATIP.String()})
+	} else {
+		rules = append(rules, []string{"!", "-d", multicastNet, "-j", "MASQUERADE"})
 	}
-
-	return ipt.AppendUnique("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment)
+	return rules
 }
 
 // TeardownIPMasq undoes the effects of SetupIPMasq
@@ -0,0 +1,140 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPMasq", func() {
+	parseCIDR := func(s string) *net.IPNet {
+		_, ipn, err := net.ParseCIDR(s)
+		Expect(err).NotTo(HaveOccurred())
+		return ipn
+	}
+
+	It("masquerades everything but the network and multicast by default", func() {
+		Expect(ipMasqRules(parseCIDR("10.1.2.0/24"), nil)).To(Equal([][]string{
+			{"-d", "10.1.2.0/24", "-j", "ACCEPT"},
+			{"!", "-d", "224.0.0.0/4", "-j", "MASQUERADE"},
+		}))
+	})
+
+	It("exempts the non-masquerade CIDRs of the same family and uses SNAT", func() {
+		opts, err := ParseIPMasqOptions([]string{"10.0.0.0/8", "fd00::/8", "172.16.0.0/12"}, "192.0.2.10")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ipMasqRules(parseCIDR("10.1.2.0/24"), opts)).To(Equal([][]string{
+			{"-d", "10.1.2.0/24", "-j", "ACCEPT"},
+			{"-d", "10.0.0.0/8", "-j", "ACCEPT"},
+			{"-d", "172.16.0.0/12", "-j", "ACCEPT"},
+			{"!", "-d", "224.0.0.0/4", "-j", "SNAT", "--to-source", "192.0.2.10"},
+		}))
+
+		// The SNAT address only applies to its own family
+		Expect(ipMasqRules(parseCIDR("2001:db8::/64"), opts)).To(Equal([][]string{
+			{"-d", "2001:db8::/64", "-j", "ACCEPT"},
+			{"-d", "fd00::/8", "-j", "ACCEPT"},
+			{"!", "-d", "ff00::/8", "-j", "MASQUERADE"},
+		}))
+	})
+
+	It("rejects invalid options", func() {
+		_, err := ParseIPMasqOptions([]string{"10.0.0.0"}, "")
+		Expect(err).To(MatchError(HavePrefix(`invalid nonMasqueradeCIDRs entry "10.0.0.0"`)))
+		_, err = ParseIPMasqOptions(nil, "foo")
+		Expect(err).To(MatchError(`invalid snatIP "foo"`))
+	})
+
+	It("uses one set per family for the shared chain", func() {
+		chain := "CNI-0123456789abcdef01234567"
+		set4 := SharedIPMasqSetName(chain, net.ParseIP("10.1.2.3"))
+		set6 := SharedIPMasqSetName(chain, net.ParseIP("2001:db8::3"))
+		Expect(set4).To(Equal(chain + "-4"))
+		Expect(set6).To(Equal(chain + "-6"))
+		// ipset names are limited to 31 characters
+		Expect(len(set4)).To(BeNumerically("<=", 31))
+
+		Expect(sharedIPMasqJump(set4, chain, `name: "test"`)).To(Equal([]string{
+			"-m", "set", "--match-set", set4, "src", "-j", chain, "-m", "comment", "--comment", `name: "test"`,
+		}))
+	})
+
+	It("finds the MASQUERADE and SNAT rules of the shared chain", func() {
+		chain := "CNI-0123456789abcdef01234567"
+		lines := []string{
+			"-N " + chain,
+			"-A " + chain + ` -d 10.1.2.0/24 -m comment --comment "name: \"test\"" -j ACCEPT`,
+			"-A " + chain + ` ! -d 224.0.0.0/4 -m comment --comment "name: \"test\"" -j MASQUERADE`,
+			"-A " + chain + ` -d 10.1.3.0/24 -m comment --comment "name: \"test\"" -j ACCEPT`,
+			"-A " + chain + ` ! -d 224.0.0.0/4 -m comment --comment "name: \"test\"" -j SNAT --to-source 192.168.1.1`,
+		}
+		Expect(ipMasqTargetRules(lines)).To(Equal([]int{2, 4}))
+		Expect(ipMasqTargetRules(lines[:2])).To(BeEmpty())
+	})
+
+	It("finds the ACCEPT rules of nonMasqueradeCIDRs that are no longer set", func() {
+		chain := "CNI-0123456789abcdef01234567"
+		lines := []string{
+			"-N " + chain,
+			"-A " + chain + " -d 10.96.0.0/12 -m comment --comment nonMasqueradeCIDRs -j ACCEPT",
+			"-A " + chain + " -d 192.168.0.0/16 -m comment --comment nonMasqueradeCIDRs -j ACCEPT",
+			"-A " + chain + ` -d 10.1.2.0/24 -m comment --comment "name: \"test\"" -j ACCEPT`,
+			"-A " + chain + ` ! -d 224.0.0.0/4 -m comment --comment "name: \"test\"" -j MASQUERADE`,
+		}
+		Expect(staleIPMasqCIDRRules(lines, []string{"10.96.0.0/12"})).To(Equal([]int{2}))
+		Expect(staleIPMasqCIDRRules(lines, nil)).To(Equal([]int{1, 2}))
+		Expect(staleIPMasqCIDRRules(lines, []string{"10.96.0.0/12", "192.168.0.0/16"})).To(BeEmpty())
+	})
+
+	It("serializes the updates of the shared chain", func() {
+		dir, err := ioutil.TempDir("", "ipmasq")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		origLockDir := sharedIPMasqLockDir
+		sharedIPMasqLockDir = filepath.Join(dir, "lock")
+		defer func() { sharedIPMasqLockDir = origLockDir }()
+
+		var running, maxRunning int32
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				Expect(withSharedIPMasqLock("CNI-test", func() error {
+					n := atomic.AddInt32(&running, 1)
+					if n > atomic.LoadInt32(&maxRunning) {
+						atomic.StoreInt32(&maxRunning, n)
+					}
+					time.Sleep(10 * time.Millisecond)
+					atomic.AddInt32(&running, -1)
+					return nil
+				})).To(Succeed())
+			}()
+		}
+		wg.Wait()
+		Expect(maxRunning).To(Equal(int32(1)))
+	})
+})
@@ -0,0 +1,255 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alexflint/go-filemutex"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// The shared masquerade chain of a network is jumped to once from
+// POSTROUTING, for packets from the addresses in an ipset, instead of once
+// for every container.
+
+var sharedIPMasqLockDir = "/run/cni/ipmasq"
+
+// sharedIPMasqCIDRComment marks the ACCEPT rules of nonMasqueradeCIDRs in
+// the shared chain, so that they can be removed once they are no longer set
+const sharedIPMasqCIDRComment = "nonMasqueradeCIDRs"
+
+// SharedIPMasqSetName returns the name of the ipset with the container
+// addresses of the family of ip that use the shared chain
+func SharedIPMasqSetName(chain string, ip net.IP) string {
+	if ip.To4() == nil {
+		return chain + "-6"
+	}
+	return chain + "-4"
+}
+
+// SetupIPMasqShared masquerades traffic from the container address ipn.IP
+// going outside of its network ipn, using the chain shared by the
+// containers of the network
+func SetupIPMasqShared(ipn *net.IPNet, chain string, comment string, opts *IPMasqOptions) error {
+	isV6 := ipn.IP.To4() == nil
+	set := SharedIPMasqSetName(chain, ipn.IP)
+
+	family := "inet"
+	if isV6 {
+		family = "inet6"
+	}
+	if err := runIPSet("create", set, "hash:ip", "family", family, "-exist"); err != nil {
+		return err
+	}
+	if err := runIPSet("add", set, ipn.IP.String(), "-exist"); err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables(isV6)
+	if err != nil {
+		return err
+	}
+
+	// Concurrent ADDs of the network update the same chain
+	return withSharedIPMasqLock(chain, func() error {
+		if err := ensureNatChain(ipt, chain); err != nil {
+			return err
+		}
+		if err := updateSharedIPMasqChain(ipt, chain, comment, ipMasqRules(Network(ipn), opts)); err != nil {
+			return err
+		}
+		return ipt.AppendUnique("nat", "POSTROUTING", sharedIPMasqJump(set, chain, comment)...)
+	})
+}
+
+// TeardownIPMasqShared stops masquerading traffic from the container
+// address ipn.IP. The shared chain stays, other containers may still use it.
+func TeardownIPMasqShared(ipn *net.IPNet, chain string) error {
+	err := runIPSet("del", SharedIPMasqSetName(chain, ipn.IP), ipn.IP.String(), "-exist")
+	if err != nil && !strings.Contains(err.Error(), "does not exist") {
+		return err
+	}
+	return nil
+}
+
+// updateSharedIPMasqChain brings the shared chain in line with rules, as
+// returned by ipMasqRules: the chain starts with the ACCEPT rules of the
+// subnets of all containers and of the current nonMasqueradeCIDRs, and ends
+// with exactly one MASQUERADE or SNAT rule.
+func updateSharedIPMasqChain(ipt *iptables.IPTables, chain, comment string, rules [][]string) error {
+	subnetRule := append(rules[0], "-m", "comment", "--comment", comment)
+	var cidrs []string
+	var cidrRules [][]string
+	for _, rule := range rules[1 : len(rules)-1] {
+		cidrs = append(cidrs, rule[1])
+		cidrRules = append(cidrRules, append(rule, "-m", "comment", "--comment", sharedIPMasqCIDRComment))
+	}
+	target := append(rules[len(rules)-1], "-m", "comment", "--comment", comment)
+
+	lines, err := ipt.List("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to list chain %s: %v", chain, err)
+	}
+	// Delete from the end, so the numbers of the others stay the same
+	stale := staleIPMasqCIDRRules(lines, cidrs)
+	for i := len(stale) - 1; i >= 0; i-- {
+		if err := ipt.Delete("nat", chain, strconv.Itoa(stale[i])); err != nil {
+			return err
+		}
+	}
+
+	// New ACCEPT rules go to the top, so they are reached
+	for _, rule := range append([][]string{subnetRule}, cidrRules...) {
+		exists, err := ipt.Exists("nat", chain, rule...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := ipt.Insert("nat", chain, 1, rule...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ensureSharedIPMasqTarget(ipt, chain, target)
+}
+
+// staleIPMasqCIDRRules returns the numbers of the ACCEPT rules of
+// nonMasqueradeCIDRs in the output of iptables -S for a chain whose CIDR is
+// not one of cidrs
+func staleIPMasqCIDRRules(lines []string, cidrs []string) []int {
+	var stale []int
+	for i, line := range lines {
+		if i == 0 || !strings.Contains(line, " --comment "+sharedIPMasqCIDRComment+" -j ACCEPT") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for j := 0; j < len(fields)-1; j++ {
+			if fields[j] == "-d" && !containsString(cidrs, fields[j+1]) {
+				stale = append(stale, i)
+				break
+			}
+		}
+	}
+	return stale
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureSharedIPMasqTarget makes rule the last and only MASQUERADE or SNAT
+// rule of chain. It is appended before the others are deleted, so traffic
+// is masqueraded throughout.
+func ensureSharedIPMasqTarget(ipt *iptables.IPTables, chain string, rule []string) error {
+	lines, err := ipt.List("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to list chain %s: %v", chain, err)
+	}
+	exists, err := ipt.Exists("nat", chain, rule...)
+	if err != nil {
+		return err
+	}
+	targets := ipMasqTargetRules(lines)
+	if exists && len(targets) == 1 && targets[0] == len(lines)-1 {
+		return nil
+	}
+
+	if err := ipt.Append("nat", chain, rule...); err != nil {
+		return err
+	}
+	// Delete from the end, so the numbers of the others stay the same
+	for i := len(targets) - 1; i >= 0; i-- {
+		if err := ipt.Delete("nat", chain, strconv.Itoa(targets[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ipMasqTargetRules returns the numbers of the MASQUERADE and SNAT rules in
+// the output of iptables -S for a chain, whose first line creates the chain
+func ipMasqTargetRules(lines []string) []int {
+	var targets []int
+	for i, line := range lines {
+		if i == 0 {
+			continue
+		}
+		if strings.Contains(line, " -j MASQUERADE") || strings.Contains(line, " -j SNAT") {
+			targets = append(targets, i)
+		}
+	}
+	return targets
+}
+
+// withSharedIPMasqLock runs f while holding the lock of the shared chain
+func withSharedIPMasqLock(chain string, f func() error) error {
+	if err := os.MkdirAll(sharedIPMasqLockDir, 0700); err != nil {
+		return fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	m, err := filemutex.New(filepath.Join(sharedIPMasqLockDir, chain+".lock"))
+	if err != nil {
+		return fmt.Errorf("failed to open lock of %q: %v", chain, err)
+	}
+	defer m.Close()
+
+	if err := m.Lock(); err != nil {
+		return fmt.Errorf("failed to lock %q: %v", chain, err)
+	}
+	return f()
+}
+
+func sharedIPMasqJump(set, chain, comment string) []string {
+	return []string{"-m", "set", "--match-set", set, "src", "-j", chain, "-m", "comment", "--comment", comment}
+}
+
+func newIPTables(isV6 bool) (*iptables.IPTables, error) {
+	proto := iptables.ProtocolIPv4
+	if isV6 {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	return ipt, nil
+}
+
+func runIPSet(args ...string) error {
+	path, err := exec.LookPath("ipset")
+	if err != nil {
+		return fmt.Errorf("failed to locate ipset: %v", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running ipset %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -31,12 +31,13 @@ var (
 	ErrLinkNotFound = errors.New("link not found")
 )
 
-func makeVethPair(name, peer string, mtu int) (netlink.Link, error) {
+func makeVethPair(name, peer string, mtu int, mac net.HardwareAddr) (netlink.Link, error) {
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
-			Name:  name,
-			Flags: net.FlagUp,
-			MTU:   mtu,
+			Name:         name,
+			Flags:        net.FlagUp,
+			MTU:          mtu,
+			HardwareAddr: mac,
 		},
 		PeerName: peer,
 	}
@@ -60,14 +61,14 @@ func peerExists(name string) bool {
 	return true
 }
 
-func makeVeth(name string, mtu int) (peerName string, veth netlink.Link, err error) {
+func makeVeth(name string, mtu int, mac net.HardwareAddr) (peerName string, veth netlink.Link, err error) {
 	for i := 0; i < 10; i++ {
 		peerName, err = RandomVethName()
 		if err != nil {
 			return
 		}
 
-		veth, err = makeVethPair(name, peerName, mtu)
+		veth, err = makeVethPair(name, peerName, mtu, mac)
 		switch {
 		case err == nil:
 			return
@@ -126,7 +127,14 @@ func ifaceFromNetlinkLink(l netlink.Link) net.Interface {
 // devices and move the host-side veth into the provided hostNS namespace.
 // On success, SetupVeth returns (hostVeth, containerVeth, nil)
 func SetupVeth(contVethName string, mtu int, hostNS ns.NetNS) (net.Interface, net.Interface, error) {
-	hostVethName, contVeth, err := makeVeth(contVethName, mtu)
+	return SetupVethWithMAC(contVethName, mtu, nil, hostNS)
+}
+
+// SetupVethWithMAC is like SetupVeth, but creates the container veth with
+// the contVethMAC MAC address, so that it never comes up with another one.
+// A nil contVethMAC leaves the choice to the kernel.
+func SetupVethWithMAC(contVethName string, mtu int, contVethMAC net.HardwareAddr, hostNS ns.NetNS) (net.Interface, net.Interface, error) {
+	hostVethName, contVeth, err := makeVeth(contVethName, mtu, contVethMAC)
 	if err != nil {
 		return net.Interface{}, net.Interface{}, err
 	}
@@ -308,4 +308,20 @@ var _ = Describe("Link", func() {
 			return nil
 		})
 	})
+	It("SetupVethWithMAC must create the container veth with the MAC address", func() {
+		mac, err := net.ParseMAC("0a:58:0a:01:02:03")
+		Expect(err).NotTo(HaveOccurred())
+		// The peer needs another name than the one of the first veth
+		rand.Reader = originalRandReader
+
+		_ = containerNetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, containerVeth, err := ip.SetupVethWithMAC("macveth", mtu, mac, hostNetNS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(containerVeth.HardwareAddr).To(Equal(mac))
+			Expect(getHwAddr("macveth")).To(Equal(mac.String()))
+			return nil
+		})
+	})
 })
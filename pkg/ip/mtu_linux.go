@@ -0,0 +1,102 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// MTU is the mtu option of a network configuration. Besides a number, it
+// may be "auto", which ResolveMTU turns into the MTU of a host interface.
+type MTU int
+
+// MTUAuto is the value of an "auto" mtu option
+const MTUAuto MTU = -1
+
+// minMTU is the smallest MTU IPv4 allows
+const minMTU = 68
+
+func (m *MTU) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != "auto" {
+			return fmt.Errorf("invalid mtu %q: must be a number or \"auto\"", s)
+		}
+		*m = MTUAuto
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("invalid mtu %s: must be a number or \"auto\"", data)
+	}
+	*m = MTU(n)
+	return nil
+}
+
+func (m MTU) MarshalJSON() ([]byte, error) {
+	if m == MTUAuto {
+		return json.Marshal("auto")
+	}
+	return json.Marshal(int(m))
+}
+
+// ResolveMTU returns the MTU to use for an mtu option. For "auto", that is
+// the MTU of the named interface, or of the interface of the default route,
+// minus overhead.
+func ResolveMTU(mtu MTU, ifName string, overhead int) (int, error) {
+	if mtu != MTUAuto {
+		return int(mtu), nil
+	}
+	if overhead < 0 {
+		return 0, fmt.Errorf("invalid mtu overhead %d", overhead)
+	}
+
+	var link netlink.Link
+	var err error
+	if ifName != "" {
+		link, err = netlink.LinkByName(ifName)
+	} else {
+		link, err = defaultRouteLink()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the interface to derive the MTU from: %v", err)
+	}
+
+	resolved := link.Attrs().MTU - overhead
+	if resolved < minMTU {
+		return 0, fmt.Errorf("MTU of %q minus overhead %d is too small: %d", link.Attrs().Name, overhead, resolved)
+	}
+	return resolved, nil
+}
+
+// defaultRouteLink returns the interface of the IPv4 default route, or of
+// the IPv6 one if there is no IPv4 default route
+func defaultRouteLink() (netlink.Link, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			if route.Dst == nil && route.LinkIndex > 0 {
+				return netlink.LinkByIndex(route.LinkIndex)
+			}
+		}
+	}
+	return nil, fmt.Errorf("there is no default route")
+}
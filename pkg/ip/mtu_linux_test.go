@@ -0,0 +1,104 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"encoding/json"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+)
+
+var _ = Describe("MTU", func() {
+	It("parses numbers and \"auto\"", func() {
+		var conf struct {
+			MTU ip.MTU `json:"mtu"`
+		}
+		Expect(json.Unmarshal([]byte(`{"mtu": 1400}`), &conf)).To(Succeed())
+		Expect(conf.MTU).To(Equal(ip.MTU(1400)))
+		Expect(json.Unmarshal([]byte(`{"mtu": "auto"}`), &conf)).To(Succeed())
+		Expect(conf.MTU).To(Equal(ip.MTUAuto))
+
+		Expect(json.Unmarshal([]byte(`{"mtu": "big"}`), &conf)).To(MatchError(`invalid mtu "big": must be a number or "auto"`))
+		Expect(json.Unmarshal([]byte(`{"mtu": true}`), &conf)).To(MatchError(`invalid mtu true: must be a number or "auto"`))
+	})
+
+	Describe("ResolveMTU", func() {
+		var testNS ns.NetNS
+
+		BeforeEach(func() {
+			var err error
+			testNS, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: "uplink0", MTU: 9000},
+					PeerName:  "peer0",
+				})).To(Succeed())
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: "wan0", MTU: 1450},
+					PeerName:  "peer1",
+				})).To(Succeed())
+
+				wan, err := netlink.LinkByName("wan0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(wan)).To(Succeed())
+				addr, err := netlink.ParseAddr("192.168.77.2/24")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.AddrAdd(wan, addr)).To(Succeed())
+				peer, err := netlink.LinkByName("peer1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(peer)).To(Succeed())
+				return netlink.RouteAdd(&netlink.Route{
+					LinkIndex: wan.Attrs().Index,
+					Gw:        net.ParseIP("192.168.77.1"),
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(testNS.Close()).To(Succeed())
+		})
+
+		It("keeps a configured MTU", func() {
+			Expect(ip.ResolveMTU(1400, "", 50)).To(Equal(1400))
+		})
+
+		It("derives the MTU from the named interface or the default route", func() {
+			err := testNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(ip.ResolveMTU(ip.MTUAuto, "uplink0", 50)).To(Equal(8950))
+				Expect(ip.ResolveMTU(ip.MTUAuto, "", 0)).To(Equal(1450))
+
+				_, err := ip.ResolveMTU(ip.MTUAuto, "", 1400)
+				Expect(err).To(MatchError(`MTU of "wan0" minus overhead 1400 is too small: 50`))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
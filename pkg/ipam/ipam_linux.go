@@ -119,3 +119,35 @@ func ConfigureIface(ifName string, res *current.Result) error {
 
 	return nil
 }
+
+// ConfigureGatewayNeighbors adds permanent neighbor entries for the gateways
+// of the IP configurations of res to the ifName interface, so that it doesn't
+// have to resolve them. All gateways are expected at hwAddr.
+func ConfigureGatewayNeighbors(ifName string, res *current.Result, hwAddr net.HardwareAddr) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	for _, ipc := range res.IPs {
+		if ipc.Gateway == nil {
+			continue
+		}
+		family := netlink.FAMILY_V6
+		if ipc.Gateway.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+		neigh := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       family,
+			State:        netlink.NUD_PERMANENT,
+			IP:           ipc.Gateway,
+			HardwareAddr: hwAddr,
+		}
+		if err := netlink.NeighSet(neigh); err != nil {
+			return fmt.Errorf("failed to add neighbor '%v lladdr %v dev %v': %v", ipc.Gateway, hwAddr, ifName, err)
+		}
+	}
+
+	return nil
+}
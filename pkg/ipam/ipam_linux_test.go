@@ -298,3 +298,71 @@ var _ = Describe("ConfigureIface", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 })
+
+var _ = Describe("ConfigureGatewayNeighbors", func() {
+	var originalNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			return netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: LINK_NAME},
+				PeerName:  "peer0",
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("adds permanent neighbor entries for the gateways", func() {
+		hwAddr, err := net.ParseMAC("0a:58:0a:01:02:01")
+		Expect(err).NotTo(HaveOccurred())
+		ipv4, err := types.ParseCIDR("1.2.3.30/24")
+		Expect(err).NotTo(HaveOccurred())
+		ipv6, err := types.ParseCIDR("abcd:1234:ffff::cdde/64")
+		Expect(err).NotTo(HaveOccurred())
+
+		result := &current.Result{
+			IPs: []*current.IPConfig{
+				{Version: "4", Address: *ipv4, Gateway: net.ParseIP("1.2.3.1")},
+				{Version: "6", Address: *ipv6, Gateway: net.ParseIP("abcd:1234:ffff::1")},
+				{Version: "4", Address: *ipv4},
+			},
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(ConfigureGatewayNeighbors(LINK_NAME, result, hwAddr)).To(Succeed())
+			// Running it again is fine
+			Expect(ConfigureGatewayNeighbors(LINK_NAME, result, hwAddr)).To(Succeed())
+
+			link, err := netlink.LinkByName(LINK_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				neighs, err := netlink.NeighList(link.Attrs().Index, family)
+				Expect(err).NotTo(HaveOccurred())
+				var gateways []string
+				for _, neigh := range neighs {
+					if neigh.State == netlink.NUD_PERMANENT {
+						Expect(neigh.HardwareAddr).To(Equal(hwAddr))
+						gateways = append(gateways, neigh.IP.String())
+					}
+				}
+				if family == netlink.FAMILY_V4 {
+					Expect(gateways).To(ConsistOf("1.2.3.1"))
+				} else {
+					Expect(gateways).To(ConsistOf("abcd:1234:ffff::1"))
+				}
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
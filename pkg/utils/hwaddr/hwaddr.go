@@ -33,6 +33,10 @@ type SupportIp4OnlyErr struct{ msg string }
 
 func (e SupportIp4OnlyErr) Error() string { return e.msg }
 
+type SupportIp6OnlyErr struct{ msg string }
+
+func (e SupportIp6OnlyErr) Error() string { return e.msg }
+
 type MacParseErr struct{ msg string }
 
 func (e MacParseErr) Error() string { return e.msg }
@@ -41,6 +45,10 @@ type InvalidPrefixLengthErr struct{ msg string }
 
 func (e InvalidPrefixLengthErr) Error() string { return e.msg }
 
+type InvalidPrefixErr struct{ msg string }
+
+func (e InvalidPrefixErr) Error() string { return e.msg }
+
 // GenerateHardwareAddr4 generates 48 bit virtual mac addresses based on the IP4 input.
 func GenerateHardwareAddr4(ip net.IP, prefix []byte) (net.HardwareAddr, error) {
 	switch {
@@ -61,3 +69,66 @@ func GenerateHardwareAddr4(ip net.IP, prefix []byte) (net.HardwareAddr, error) {
 			ip[ipByteLen-ipRelevantByteLen:ipByteLen]...),
 	), nil
 }
+
+// GenerateHardwareAddr6 generates 48 bit virtual mac addresses based on the
+// low 32 bits of the IP6 input. The prefix must be locally administered and
+// unicast, like PrivateMACPrefix.
+func GenerateHardwareAddr6(ip net.IP, prefix []byte) (net.HardwareAddr, error) {
+	switch {
+
+	case ip.To16() == nil || ip.To4() != nil:
+		return nil, SupportIp6OnlyErr{msg: "GenerateHardwareAddr6 only supports valid IPv6 address as input"}
+
+	case len(prefix) != len(PrivateMACPrefix):
+		return nil, InvalidPrefixLengthErr{msg: fmt.Sprintf(
+			"Prefix has length %d instead  of %d", len(prefix), len(PrivateMACPrefix)),
+		}
+
+	case prefix[0]&0x03 != 0x02:
+		return nil, InvalidPrefixErr{msg: fmt.Sprintf(
+			"Prefix %x is not a locally administered unicast prefix", prefix),
+		}
+	}
+
+	mac := make(net.HardwareAddr, 0, 6)
+	mac = append(mac, prefix...)
+	return append(mac, ip[net.IPv6len-ipRelevantByteLen:]...), nil
+}
+
+// EUI64 returns the modified EUI-64 interface identifier of a 48 bit mac
+// address, which SLAAC uses for the low 64 bits of the IP6 address
+func EUI64(mac net.HardwareAddr) ([]byte, error) {
+	if len(mac) != 6 {
+		return nil, MacParseErr{msg: fmt.Sprintf("EUI64 only supports 48 bit mac addresses, not %q", mac)}
+	}
+	return []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}, nil
+}
+
+// EUI64Addr returns the IP6 address SLAAC assigns to an interface with the
+// mac address in the /64 prefix
+func EUI64Addr(prefix *net.IPNet, mac net.HardwareAddr) (net.IP, error) {
+	if ones, bits := prefix.Mask.Size(); ones != 64 || bits != 8*net.IPv6len {
+		return nil, InvalidPrefixLengthErr{msg: fmt.Sprintf("SLAAC requires a /64 IPv6 prefix, not %v", prefix)}
+	}
+	id, err := EUI64(mac)
+	if err != nil {
+		return nil, err
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:8])
+	copy(ip[8:], id)
+	return ip, nil
+}
+
+// HardwareAddrFromEUI64 returns the mac address of the interface an IP6
+// address was assigned to by SLAAC, the inverse of EUI64Addr
+func HardwareAddrFromEUI64(ip net.IP) (net.HardwareAddr, error) {
+	if ip.To16() == nil || ip.To4() != nil {
+		return nil, SupportIp6OnlyErr{msg: "HardwareAddrFromEUI64 only supports valid IPv6 address as input"}
+	}
+	id := ip.To16()[8:]
+	if id[3] != 0xff || id[4] != 0xfe {
+		return nil, MacParseErr{msg: fmt.Sprintf("%v does not have an EUI-64 interface identifier", ip)}
+	}
+	return net.HardwareAddr{id[0] ^ 0x02, id[1], id[2], id[5], id[6], id[7]}, nil
+}
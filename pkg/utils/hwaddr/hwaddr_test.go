@@ -70,5 +70,68 @@ var _ = Describe("Hwaddr", func() {
 			_, err := hwaddr.GenerateHardwareAddr4(net.ParseIP("10.0.0.2"), []byte{0x58})
 			Expect(err).To(BeAssignableToTypeOf(hwaddr.InvalidPrefixLengthErr{}))
 		})
+
+		It("generate hardware address based on ipv6 address", func() {
+			mac, err := hwaddr.GenerateHardwareAddr6(net.ParseIP("2001:db8::a01:203"), hwaddr.PrivateMACPrefix)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mac).To(Equal((net.HardwareAddr)(append(hwaddr.PrivateMACPrefix, 0x0a, 0x01, 0x02, 0x03))))
+
+			mac, err = hwaddr.GenerateHardwareAddr6(net.ParseIP("fd00::ffff:1"), []byte{0x02, 0x42})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mac).To(Equal(net.HardwareAddr{0x02, 0x42, 0xff, 0xff, 0x00, 0x01}))
+		})
+
+		It("return error if input is not ipv6 address", func() {
+			for _, tc := range []net.IP{net.ParseIP(""), net.ParseIP("10.0.0.2")} {
+				_, err := hwaddr.GenerateHardwareAddr6(tc, hwaddr.PrivateMACPrefix)
+				Expect(err).To(BeAssignableToTypeOf(hwaddr.SupportIp6OnlyErr{}))
+			}
+		})
+
+		It("return error if ipv6 prefix is invalid", func() {
+			_, err := hwaddr.GenerateHardwareAddr6(net.ParseIP("2001:db8::2"), []byte{0x58})
+			Expect(err).To(BeAssignableToTypeOf(hwaddr.InvalidPrefixLengthErr{}))
+
+			// Globally administered
+			_, err = hwaddr.GenerateHardwareAddr6(net.ParseIP("2001:db8::2"), []byte{0x00, 0x58})
+			Expect(err).To(BeAssignableToTypeOf(hwaddr.InvalidPrefixErr{}))
+		})
+	})
+
+	Context("EUI-64", func() {
+		It("predicts the SLAAC address of a hardware address", func() {
+			mac, err := net.ParseMAC("0a:58:0a:01:02:03")
+			Expect(err).NotTo(HaveOccurred())
+			_, prefix, err := net.ParseCIDR("2001:db8:1:2::/64")
+			Expect(err).NotTo(HaveOccurred())
+
+			id, err := hwaddr.EUI64(mac)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal([]byte{0x08, 0x58, 0x0a, 0xff, 0xfe, 0x01, 0x02, 0x03}))
+
+			ip, err := hwaddr.EUI64Addr(prefix, mac)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.String()).To(Equal("2001:db8:1:2:858:aff:fe01:203"))
+
+			back, err := hwaddr.HardwareAddrFromEUI64(ip)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(back).To(Equal(mac))
+		})
+
+		It("return error if the prefix is not a /64", func() {
+			mac, err := net.ParseMAC("0a:58:0a:01:02:03")
+			Expect(err).NotTo(HaveOccurred())
+			_, prefix, err := net.ParseCIDR("2001:db8:1::/48")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = hwaddr.EUI64Addr(prefix, mac)
+			Expect(err).To(BeAssignableToTypeOf(hwaddr.InvalidPrefixLengthErr{}))
+		})
+
+		It("return error if the address has no EUI-64 interface identifier", func() {
+			_, err := hwaddr.HardwareAddrFromEUI64(net.ParseIP("2001:db8::2"))
+			Expect(err).To(BeAssignableToTypeOf(hwaddr.MacParseErr{}))
+			_, err = hwaddr.HardwareAddrFromEUI64(net.ParseIP("10.0.0.2"))
+			Expect(err).To(BeAssignableToTypeOf(hwaddr.SupportIp6OnlyErr{}))
+		})
 	})
 })
@@ -0,0 +1,111 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hwaddr
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// The values of the macFrom option of the interface plugins, which derive a
+// stable MAC address of the container interface
+const (
+	MACFromIP          = "ip"
+	MACFromContainerID = "containerID"
+)
+
+// ValidateMACFrom checks the macFrom option of an interface plugin
+func ValidateMACFrom(macFrom string) error {
+	switch macFrom {
+	case "", MACFromIP, MACFromContainerID:
+		return nil
+	default:
+		return fmt.Errorf("invalid macFrom %q (must be %q or %q)", macFrom, MACFromIP, MACFromContainerID)
+	}
+}
+
+// ParseMAC parses the MAC address of an ethernet interface, which must be a
+// 48 bit unicast address
+func ParseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, MacParseErr{msg: fmt.Sprintf("invalid MAC address %q: %v", s, err)}
+	}
+	if len(mac) != 6 {
+		return nil, MacParseErr{msg: fmt.Sprintf("invalid MAC address %q: not a 48 bit address", s)}
+	}
+	if mac[0]&0x01 != 0 {
+		return nil, MacParseErr{msg: fmt.Sprintf("invalid MAC address %q: not a unicast address", s)}
+	}
+	return mac, nil
+}
+
+// RequestedMAC returns the MAC address the runtime requested for the
+// container interface, either with the mac of the runtimeConfig or with the
+// MAC of CNI_ARGS, e.g. "MAC=0a:58:0a:01:02:03". The runtimeConfig takes
+// precedence. It returns nil if no MAC address is requested. The other
+// CNI_ARGS are not looked at, they are meant for other plugins.
+func RequestedMAC(runtimeMAC, envArgs string) (net.HardwareAddr, error) {
+	if runtimeMAC != "" {
+		return ParseMAC(runtimeMAC)
+	}
+	for _, pair := range strings.Split(envArgs, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && kv[0] == "MAC" && kv[1] != "" {
+			return ParseMAC(kv[1])
+		}
+	}
+	return nil, nil
+}
+
+// GenerateHardwareAddrFromID generates a 48 bit locally administered unicast
+// mac address from a hash of id, e.g. a container ID
+func GenerateHardwareAddrFromID(id string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(id))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac
+}
+
+// ResolveMAC returns the MAC address of the container interface: the one the
+// runtime requested, otherwise one derived as macFrom says. It returns nil if
+// the kernel should choose it.
+func ResolveMAC(runtimeMAC, envArgs, macFrom, containerID string, ips []*current.IPConfig) (net.HardwareAddr, error) {
+	mac, err := RequestedMAC(runtimeMAC, envArgs)
+	if err != nil || mac != nil {
+		return mac, err
+	}
+
+	switch macFrom {
+	case MACFromIP:
+		// IPv4 addresses are preferred, since they fit whole
+		for _, ipc := range ips {
+			if ipc.Address.IP.To4() != nil {
+				return GenerateHardwareAddr4(ipc.Address.IP, PrivateMACPrefix)
+			}
+		}
+		if len(ips) > 0 {
+			return GenerateHardwareAddr6(ips[0].Address.IP, PrivateMACPrefix)
+		}
+		return nil, fmt.Errorf("macFrom %q requires an IP address", MACFromIP)
+	case MACFromContainerID:
+		return GenerateHardwareAddrFromID(containerID), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hwaddr_test
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MAC", func() {
+	ipConfig := func(addr string) *current.IPConfig {
+		ip, ipn, err := net.ParseCIDR(addr)
+		Expect(err).NotTo(HaveOccurred())
+		ipn.IP = ip
+		return &current.IPConfig{Address: *ipn}
+	}
+
+	It("prefers the runtimeConfig over CNI_ARGS", func() {
+		mac, err := hwaddr.RequestedMAC("0a:58:0a:01:02:03", "IgnoreUnknown=1;MAC=0a:58:0a:01:02:04")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:0a:01:02:03"))
+
+		mac, err = hwaddr.RequestedMAC("", "IgnoreUnknown=1;MAC=0a:58:0a:01:02:04")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:0a:01:02:04"))
+
+		mac, err = hwaddr.RequestedMAC("", "IgnoreUnknown=1;K8S_POD_NAME=pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(BeNil())
+	})
+
+	It("ignores the CNI_ARGS of other plugins", func() {
+		mac, err := hwaddr.RequestedMAC("", "FOO=bar")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(BeNil())
+
+		mac, err = hwaddr.RequestedMAC("", "FOO=bar;MAC=0a:58:0a:01:02:04")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:0a:01:02:04"))
+
+		mac, err = hwaddr.ResolveMAC("", "FOO=bar", "", "dummy", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(BeNil())
+	})
+
+	It("rejects invalid MAC addresses", func() {
+		for _, s := range []string{"bogus", "01:00:5e:00:00:01", "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"} {
+			_, err := hwaddr.ParseMAC(s)
+			Expect(err).To(BeAssignableToTypeOf(hwaddr.MacParseErr{}))
+		}
+	})
+
+	It("derives the MAC address from the first IPv4 address, if any", func() {
+		ips := []*current.IPConfig{ipConfig("2001:db8::3/64"), ipConfig("10.1.2.3/24")}
+		mac, err := hwaddr.ResolveMAC("", "", hwaddr.MACFromIP, "dummy", ips)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:0a:01:02:03"))
+
+		// IPv6-only containers get the low bits of their address
+		mac, err = hwaddr.ResolveMAC("", "", hwaddr.MACFromIP, "dummy", ips[:1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:00:00:00:03"))
+
+		_, err = hwaddr.ResolveMAC("", "", hwaddr.MACFromIP, "dummy", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("derives a stable unicast MAC address from the container ID", func() {
+		mac, err := hwaddr.ResolveMAC("", "", hwaddr.MACFromContainerID, "dummy", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(Equal(hwaddr.GenerateHardwareAddrFromID("dummy")))
+		Expect(mac).NotTo(Equal(hwaddr.GenerateHardwareAddrFromID("other")))
+		Expect(mac[0] & 0x03).To(Equal(byte(0x02)))
+	})
+
+	It("prefers the requested MAC address and otherwise leaves it to the kernel", func() {
+		mac, err := hwaddr.ResolveMAC("0a:58:0a:01:02:04", "", hwaddr.MACFromContainerID, "dummy", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:0a:01:02:04"))
+
+		mac, err = hwaddr.ResolveMAC("", "", "", "dummy", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(BeNil())
+	})
+
+	It("validates macFrom", func() {
+		Expect(hwaddr.ValidateMACFrom("")).To(Succeed())
+		Expect(hwaddr.ValidateMACFrom(hwaddr.MACFromIP)).To(Succeed())
+		Expect(hwaddr.ValidateMACFrom("random")).To(MatchError(`invalid macFrom "random" (must be "ip" or "containerID")`))
+	})
+})
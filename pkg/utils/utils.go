@@ -39,3 +39,9 @@ func FormatChainName(name string, id string) string {
 func FormatComment(name string, id string) string {
 	return fmt.Sprintf("name: %q id: %q", name, id)
 }
+
+// FormatNetworkComment returns a comment used for easier
+// identification of the rules of a whole network within iptables.
+func FormatNetworkComment(name string) string {
+	return fmt.Sprintf("name: %q", name)
+}
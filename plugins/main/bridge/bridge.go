@@ -32,22 +32,67 @@ import (
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 )
 
-const defaultBrName = "cni0"
+const (
+	defaultBrName = "cni0"
+	minVlanID     = 1
+	maxVlanID     = 4094
+	defaultVlanID = 1
+)
 
 type NetConf struct {
 	types.NetConf
-	BrName       string `json:"bridge"`
-	IsGW         bool   `json:"isGateway"`
-	IsDefaultGW  bool   `json:"isDefaultGateway"`
-	ForceAddress bool   `json:"forceAddress"`
-	IPMasq       bool   `json:"ipMasq"`
-	MTU          int    `json:"mtu"`
-	HairpinMode  bool   `json:"hairpinMode"`
-	PromiscMode  bool   `json:"promiscMode"`
+	BrName       string       `json:"bridge"`
+	IsGW         bool         `json:"isGateway"`
+	IsDefaultGW  bool         `json:"isDefaultGateway"`
+	ForceAddress bool         `json:"forceAddress"`
+	IPMasq       bool         `json:"ipMasq"`
+	MTU          ip.MTU       `json:"mtu"`
+	HairpinMode  bool         `json:"hairpinMode"`
+	PromiscMode  bool         `json:"promiscMode"`
+	Vlan         int          `json:"vlan"`
+	VlanTrunk    []*VlanTrunk `json:"vlanTrunk,omitempty"`
+	Uplink       string       `json:"uplink,omitempty"`
+	MacSpoofChk  bool         `json:"macspoofchk"`
+	IPSpoofChk   bool         `json:"ipspoofchk"`
+	Isolation    bool         `json:"isolation"`
+
+	DeleteBridgeWhenEmpty bool `json:"deleteBridgeWhenEmpty"`
+
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs,omitempty"`
+	SNATIP             string   `json:"snatIP,omitempty"`
+	IPMasqShared       bool     `json:"ipMasqShared"`
+
+	MTUInterface string `json:"mtuInterface,omitempty"`
+	MTUOverhead  int    `json:"mtuOverhead,omitempty"`
+
+	McastSnooping *bool `json:"mcastSnooping,omitempty"`
+	McastQuerier  *bool `json:"mcastQuerier,omitempty"`
+	STP           *bool `json:"stp,omitempty"`
+	ForwardDelay  *int  `json:"forwardDelay,omitempty"`
+	AgeingTime    *int  `json:"ageingTime,omitempty"`
+
+	StaticGatewayNeighbor bool `json:"staticGatewayNeighbor"`
+
+	MACFrom       string `json:"macFrom,omitempty"`
+	RuntimeConfig struct {
+		MAC string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	vlans         []int
+	ipMasqOptions *ip.IPMasqOptions
+}
+
+// VlanTrunk is an entry of the vlanTrunk option: either a single VLAN ID, or
+// a range of VLAN IDs from MinID to MaxID.
+type VlanTrunk struct {
+	ID    *int `json:"id,omitempty"`
+	MinID *int `json:"minID,omitempty"`
+	MaxID *int `json:"maxID,omitempty"`
 }
 
 type gwInfo struct {
@@ -70,9 +115,67 @@ func loadNetConf(bytes []byte) (*NetConf, string, error) {
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if n.Vlan < 0 || n.Vlan > maxVlanID {
+		return nil, "", fmt.Errorf("invalid VLAN ID %d (must be between 0 and %d)", n.Vlan, maxVlanID)
+	}
+	vlans, err := collectVlanTrunk(n.VlanTrunk)
+	if err != nil {
+		return nil, "", err
+	}
+	n.vlans = vlans
+	n.ipMasqOptions, err = ip.ParseIPMasqOptions(n.NonMasqueradeCIDRs, n.SNATIP)
+	if err != nil {
+		return nil, "", err
+	}
+	if n.ForwardDelay != nil && (*n.ForwardDelay < 2 || *n.ForwardDelay > 30) {
+		return nil, "", fmt.Errorf("invalid forwardDelay %d (must be between 2 and 30 seconds)", *n.ForwardDelay)
+	}
+	if err := hwaddr.ValidateMACFrom(n.MACFrom); err != nil {
+		return nil, "", err
+	}
+	if n.AgeingTime != nil && *n.AgeingTime < 0 {
+		return nil, "", fmt.Errorf("invalid ageingTime %d", *n.AgeingTime)
+	}
 	return n, n.CNIVersion, nil
 }
 
+// collectVlanTrunk returns the VLAN IDs of the vlanTrunk option
+func collectVlanTrunk(trunks []*VlanTrunk) ([]int, error) {
+	vlans := []int{}
+	seen := map[int]bool{}
+	add := func(id int) error {
+		if id < minVlanID || id > maxVlanID {
+			return fmt.Errorf("invalid VLAN ID %d in vlanTrunk (must be between %d and %d)", id, minVlanID, maxVlanID)
+		}
+		if !seen[id] {
+			seen[id] = true
+			vlans = append(vlans, id)
+		}
+		return nil
+	}
+
+	for _, t := range trunks {
+		switch {
+		case t.ID != nil && t.MinID == nil && t.MaxID == nil:
+			if err := add(*t.ID); err != nil {
+				return nil, err
+			}
+		case t.ID == nil && t.MinID != nil && t.MaxID != nil:
+			if *t.MinID > *t.MaxID {
+				return nil, fmt.Errorf("invalid vlanTrunk range: minID %d is greater than maxID %d", *t.MinID, *t.MaxID)
+			}
+			for id := *t.MinID; id <= *t.MaxID; id++ {
+				if err := add(id); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid vlanTrunk entry: either id, or both minID and maxID must be set")
+		}
+	}
+	return vlans, nil
+}
+
 // calcGateways processes the results from the IPAM plugin and does the
 // following for each IP family:
 //    - Calculates and compiles a list of gateway addresses
@@ -205,7 +308,7 @@ func bridgeByName(name string) (*netlink.Bridge, error) {
 	return br, nil
 }
 
-func ensureBridge(brName string, mtu int, promiscMode bool) (*netlink.Bridge, error) {
+func ensureBridge(brName string, mtu int, promiscMode bool, vlanFiltering bool) (*netlink.Bridge, error) {
 	br := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: brName,
@@ -236,6 +339,13 @@ func ensureBridge(brName string, mtu int, promiscMode bool) (*netlink.Bridge, er
 		return nil, err
 	}
 
+	// Only ever turn VLAN filtering on, other networks may use the bridge
+	if vlanFiltering {
+		if err := setVlanFiltering(br, true); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := netlink.LinkSetUp(br); err != nil {
 		return nil, err
 	}
@@ -243,13 +353,36 @@ func ensureBridge(brName string, mtu int, promiscMode bool) (*netlink.Bridge, er
 	return br, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool) (*current.Interface, *current.Interface, error) {
+// setupPortVlans programs the VLAN membership of a bridge port. With an
+// access VLAN, untagged traffic of the port belongs to that VLAN instead of
+// the default one. The trunk VLANs are passed through tagged.
+func setupPortVlans(port netlink.Link, vlan int, trunk []int) error {
+	if vlan != 0 {
+		if err := netlink.BridgeVlanDel(port, defaultVlanID, true, true, false, false); err != nil {
+			return fmt.Errorf("failed to remove default VLAN from %q: %v", port.Attrs().Name, err)
+		}
+		if err := netlink.BridgeVlanAdd(port, uint16(vlan), true, true, false, false); err != nil {
+			return fmt.Errorf("failed to add VLAN %d to %q: %v", vlan, port.Attrs().Name, err)
+		}
+	}
+	for _, id := range trunk {
+		if id == vlan {
+			continue
+		}
+		if err := netlink.BridgeVlanAdd(port, uint16(id), false, false, false, false); err != nil {
+			return fmt.Errorf("failed to add trunk VLAN %d to %q: %v", id, port.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, mac net.HardwareAddr, hairpinMode bool, vlan int, trunk []int, isolationChain string) (*current.Interface, *current.Interface, error) {
 	contIface := &current.Interface{}
 	hostIface := &current.Interface{}
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, containerVeth, err := ip.SetupVethWithMAC(ifName, mtu, mac, hostNS)
 		if err != nil {
 			return err
 		}
@@ -280,6 +413,16 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 		return nil, nil, fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVeth.Attrs().Name, err)
 	}
 
+	if err := setupPortVlans(hostVeth, vlan, trunk); err != nil {
+		return nil, nil, err
+	}
+
+	if isolationChain != "" {
+		if err := setupIsolation(hostVeth, isolationChain); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	return hostIface, contIface, nil
 }
 
@@ -290,11 +433,25 @@ func calcGatewayIP(ipn *net.IPNet) net.IP {
 
 func setupBridge(n *NetConf) (*netlink.Bridge, *current.Interface, error) {
 	// create bridge if necessary
-	br, err := ensureBridge(n.BrName, n.MTU, n.PromiscMode)
+	br, err := ensureBridge(n.BrName, int(n.MTU), n.PromiscMode, n.Vlan != 0 || len(n.vlans) > 0)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
 	}
 
+	if err := setBridgeOptions(br, n); err != nil {
+		return nil, nil, err
+	}
+
+	if n.Uplink != "" {
+		if err := ensureUplink(br, n.Uplink, n.Vlan, n.vlans); err != nil {
+			return nil, nil, err
+		}
+		// Attaching the uplink may have changed the MAC address
+		if br, err = bridgeByName(n.BrName); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	return br, &current.Interface{
 		Name: br.Attrs().Name,
 		Mac:  br.Attrs().HardwareAddr.String(),
@@ -336,10 +493,27 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("cannot set hairpin mode and promiscous mode at the same time.")
 	}
 
-	br, brInterface, err := setupBridge(n)
+	// The addresses of the bridge are in the default VLAN
+	if n.IsGW && n.Vlan != 0 {
+		return fmt.Errorf("cannot set isGateway together with vlan")
+	}
+
+	// Only the addresses of the bridge are known to be at its MAC address
+	if n.StaticGatewayNeighbor && !n.IsGW {
+		return fmt.Errorf("cannot set staticGatewayNeighbor without isGateway")
+	}
+
+	// Attaching the uplink may move the default route to the bridge, so
+	// the uplink is preferred over the default route
+	mtuInterface := n.MTUInterface
+	if mtuInterface == "" {
+		mtuInterface = n.Uplink
+	}
+	mtu, err := ip.ResolveMTU(n.MTU, mtuInterface, n.MTUOverhead)
 	if err != nil {
 		return err
 	}
+	n.MTU = ip.MTU(mtu)
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -347,17 +521,50 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode)
+	isolation := ""
+	if n.Isolation {
+		isolation = isolationChainName(n.Name, args.ContainerID)
+	}
+
+	// A MAC address derived from the IPs is only known after IPAM, the
+	// others are set when the veth is created
+	macFrom := n.MACFrom
+	if macFrom == hwaddr.MACFromIP {
+		macFrom = ""
+	}
+	mac, err := hwaddr.ResolveMAC(n.RuntimeConfig.MAC, args.Args, macFrom, args.ContainerID, nil)
 	if err != nil {
 		return err
 	}
 
+	var br *netlink.Bridge
+	var brInterface, hostInterface, containerInterface *current.Interface
+	if err := withBridgeLock(n.BrName, func() error {
+		var err error
+		br, brInterface, err = setupBridge(n)
+		if err != nil {
+			return err
+		}
+		hostInterface, containerInterface, err = setupVeth(netns, br, args.IfName, int(n.MTU), mac, n.HairpinMode, n.Vlan, n.vlans, isolation)
+		return err
+	}); err != nil {
+		return err
+	}
+
 	// run the IPAM plugin and get back the config to apply
 	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	// release the IPs in case of failure
+	success := false
+	defer func() {
+		if !success {
+			ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		}
+	}()
+
 	// Convert whatever the IPAM result was into the current Result type
 	result, err := current.NewResultFromResult(r)
 	if err != nil {
@@ -368,6 +575,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return errors.New("IPAM plugin returned missing IP config")
 	}
 
+	var ipMAC net.HardwareAddr
+	if mac == nil && n.MACFrom == hwaddr.MACFromIP {
+		ipMAC, err = hwaddr.ResolveMAC("", "", n.MACFrom, args.ContainerID, result.IPs)
+		if err != nil {
+			return err
+		}
+	}
+
 	result.Interfaces = []*current.Interface{brInterface, hostInterface, containerInterface}
 
 	// Gather gateway information for each IP family
@@ -378,6 +593,22 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// Configure the container hardware address and IP address(es)
 	if err := netns.Do(func(_ ns.NetNS) error {
+		// Set a MAC address derived from the IPs while the veth is down,
+		// ConfigureIface sets it up again
+		if ipMAC != nil {
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+			}
+			if err := netlink.LinkSetDown(link); err != nil {
+				return fmt.Errorf("failed to set %q down: %v", args.IfName, err)
+			}
+			if err := netlink.LinkSetHardwareAddr(link, ipMAC); err != nil {
+				return fmt.Errorf("failed to set MAC address of %q to %v: %v", args.IfName, ipMAC, err)
+			}
+			containerInterface.Mac = ipMAC.String()
+		}
+
 		contVeth, err := net.InterfaceByName(args.IfName)
 		if err != nil {
 			return err
@@ -434,11 +665,26 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 
-	if n.IPMasq {
+	if n.MacSpoofChk || n.IPSpoofChk {
+		chain := utils.FormatChainName(n.Name, args.ContainerID)
+		if err := setupSpoofCheck(chain, hostInterface.Name, containerInterface.Mac, result.IPs, n.MacSpoofChk, n.IPSpoofChk); err != nil {
+			return fmt.Errorf("failed to set up spoof check: %v", err)
+		}
+	}
+
+	if n.IPMasq && n.IPMasqShared {
+		chain := utils.FormatChainName(n.Name, "")
+		comment := utils.FormatNetworkComment(n.Name)
+		for _, ipc := range result.IPs {
+			if err = ip.SetupIPMasqShared(&ipc.Address, chain, comment, n.ipMasqOptions); err != nil {
+				return err
+			}
+		}
+	} else if n.IPMasq {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
 		for _, ipc := range result.IPs {
-			if err = ip.SetupIPMasq(ip.Network(&ipc.Address), chain, comment); err != nil {
+			if err = ip.SetupIPMasqWithOptions(ip.Network(&ipc.Address), chain, comment, n.ipMasqOptions); err != nil {
 				return err
 			}
 		}
@@ -452,8 +698,25 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	brInterface.Mac = br.Attrs().HardwareAddr.String()
 
+	if n.StaticGatewayNeighbor {
+		// Setting the MAC address explicitly keeps the bridge from taking
+		// another one when ports come and go, which would leave the
+		// neighbor entries of the containers stale
+		hwAddr := br.Attrs().HardwareAddr
+		if err := netlink.LinkSetHardwareAddr(br, hwAddr); err != nil {
+			return fmt.Errorf("failed to set MAC address of %q: %v", n.BrName, err)
+		}
+		if err := netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureGatewayNeighbors(args.IfName, result, hwAddr)
+		}); err != nil {
+			return err
+		}
+	}
+
 	result.DNS = n.DNS
 
+	success = true
+
 	return types.PrintResult(result, cniVersion)
 }
 
@@ -467,8 +730,21 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if n.MacSpoofChk || n.IPSpoofChk {
+		chain := utils.FormatChainName(n.Name, args.ContainerID)
+		if err := teardownSpoofCheck(chain); err != nil {
+			return fmt.Errorf("failed to tear down spoof check: %v", err)
+		}
+	}
+
+	if n.Isolation {
+		if err := teardownIsolation(isolationChainName(n.Name, args.ContainerID)); err != nil {
+			return fmt.Errorf("failed to tear down isolation: %v", err)
+		}
+	}
+
 	if args.Netns == "" {
-		return nil
+		return cleanupBridge(n)
 	}
 
 	// There is a netns so try to clean up. Delete can be called multiple times
@@ -492,13 +768,52 @@ func cmdDel(args *skel.CmdArgs) error {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
 		for _, ipn := range ipnets {
+			// Containers added before the network switched to the shared
+			// chain still have a chain of their own
 			if err := ip.TeardownIPMasq(ipn, chain, comment); err != nil {
 				return err
 			}
+			if n.IPMasqShared {
+				if err := ip.TeardownIPMasqShared(ipn, utils.FormatChainName(n.Name, "")); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
-	return err
+	return cleanupBridge(n)
+}
+
+// cleanupBridge deletes the bridge, together with its addresses, if the
+// network asks for it and no ports are left
+func cleanupBridge(n *NetConf) error {
+	if !n.DeleteBridgeWhenEmpty {
+		return nil
+	}
+	return withBridgeLock(n.BrName, func() error {
+		br, err := netlink.LinkByName(n.BrName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return fmt.Errorf("could not lookup %q: %v", n.BrName, err)
+		}
+
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		for _, link := range links {
+			if link.Attrs().MasterIndex == br.Attrs().Index {
+				return nil
+			}
+		}
+
+		if err := netlink.LinkDel(br); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", n.BrName, err)
+		}
+		return nil
+	})
 }
 
 func main() {
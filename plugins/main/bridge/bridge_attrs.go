@@ -0,0 +1,204 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The vendored netlink only knows a couple of the bridge attributes, so the
+// IFLA_BR_* attributes of an existing bridge are read and changed here.
+
+// setBridgeAttr changes an IFLA_BR_* attribute of the bridge
+func setBridgeAttr(br netlink.Link, attrType int, value []byte) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, attrType, value)
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// getBridgeAttr returns the value of an IFLA_BR_* attribute of the bridge
+func getBridgeAttr(br netlink.Link, attrType int) ([]byte, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("unexpected number of links: %d", len(msgs))
+	}
+
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type != syscall.IFLA_LINKINFO {
+			continue
+		}
+		infos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Attr.Type != nl.IFLA_INFO_DATA {
+				continue
+			}
+			data, err := nl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range data {
+				if int(d.Attr.Type) == attrType {
+					return d.Value, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%q has no bridge attribute %d", br.Attrs().Name, attrType)
+}
+
+// setVlanFiltering enables or disables VLAN filtering on the bridge. A
+// bridge that already has the setting is left alone.
+func setVlanFiltering(br netlink.Link, on bool) error {
+	value := []byte{0}
+	if on {
+		value[0] = 1
+	}
+	if current, err := getBridgeAttr(br, nl.IFLA_BR_VLAN_FILTERING); err == nil && bytes.Equal(current, value) {
+		return nil
+	}
+	if err := setBridgeAttr(br, nl.IFLA_BR_VLAN_FILTERING, value); err != nil {
+		return fmt.Errorf("failed to set vlan_filtering on %q: %v", br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// setBridgePortAttr changes an IFLA_BRPORT_* attribute of a bridge port
+func setBridgePortAttr(port netlink.Link, attrType int, value []byte) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_BRIDGE)
+	msg.Index = int32(port.Attrs().Index)
+	req.AddData(msg)
+
+	protinfo := nl.NewRtAttr(syscall.IFLA_PROTINFO|syscall.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(protinfo, attrType, value)
+	req.AddData(protinfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// getBridgePortAttr returns the value of an IFLA_BRPORT_* attribute of a
+// bridge port, or nil if the kernel doesn't report it
+func getBridgePortAttr(port netlink.Link, attrType int) ([]byte, error) {
+	// Only a dump of the bridge family includes the port attributes
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_BRIDGE))
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if int(nl.DeserializeIfInfomsg(m).Index) != port.Attrs().Index {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[syscall.SizeofIfInfomsg:])
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type&^syscall.NLA_F_NESTED != syscall.IFLA_PROTINFO {
+				continue
+			}
+			infos, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				if int(info.Attr.Type&^syscall.NLA_F_NESTED) == attrType {
+					return info.Value, nil
+				}
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%q is not a bridge port", port.Attrs().Name)
+}
+
+// The kernel takes bridge times in hundredths of a second
+const userHZ = 100
+
+func boolAttr(on bool) []byte {
+	if on {
+		return nl.Uint8Attr(1)
+	}
+	return nl.Uint8Attr(0)
+}
+
+// setBridgeOptions applies the multicast and STP options of the network.
+// Options that are not set are left alone.
+func setBridgeOptions(br netlink.Link, n *NetConf) error {
+	attrs := []struct {
+		name  string
+		set   bool
+		typ   int
+		value func() []byte
+	}{
+		{"mcast_snooping", n.McastSnooping != nil, nl.IFLA_BR_MCAST_SNOOPING, func() []byte { return boolAttr(*n.McastSnooping) }},
+		{"mcast_querier", n.McastQuerier != nil, nl.IFLA_BR_MCAST_QUERIER, func() []byte { return boolAttr(*n.McastQuerier) }},
+		{"ageing_time", n.AgeingTime != nil, nl.IFLA_BR_AGEING_TIME, func() []byte { return nl.Uint32Attr(uint32(*n.AgeingTime * userHZ)) }},
+		// The forward delay is limited while STP is on, so it goes first
+		{"forward_delay", n.ForwardDelay != nil, nl.IFLA_BR_FORWARD_DELAY, func() []byte { return nl.Uint32Attr(uint32(*n.ForwardDelay * userHZ)) }},
+		{"stp_state", n.STP != nil, nl.IFLA_BR_STP_STATE, func() []byte {
+			if *n.STP {
+				return nl.Uint32Attr(1)
+			}
+			return nl.Uint32Attr(0)
+		}},
+	}
+
+	for _, attr := range attrs {
+		if !attr.set {
+			continue
+		}
+		if err := setBridgeAttr(br, attr.typ, attr.value()); err != nil {
+			return fmt.Errorf("failed to set %s on %q: %v", attr.name, br.Attrs().Name, err)
+		}
+	}
+	return nil
+}
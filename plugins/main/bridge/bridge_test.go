@@ -27,6 +27,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/testutils"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -916,4 +917,651 @@ var _ = Describe("bridge Operations", func() {
 			Expect(link.Attrs().HardwareAddr).To(Equal(origMac))
 		}
 	})
+
+	It("configures access and trunk VLANs on the host veth", func() {
+		const IFNAME = "eth0"
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "%s",
+	"vlan": 100,
+	"vlanTrunk": [
+		{"id": 200},
+		{"minID": 300, "maxID": 302}
+	],
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// Not every kernel is built with bridge VLAN filtering
+			bridge, err := ensureBridge(BRNAME, 0, false, false)
+			Expect(err).NotTo(HaveOccurred())
+			if err := setVlanFiltering(bridge, true); err != nil {
+				Skip(fmt.Sprintf("bridge VLAN filtering is not supported: %v", err))
+			}
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			filtering, err := getBridgeAttr(br, nl.IFLA_BR_VLAN_FILTERING)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filtering).To(Equal([]byte{1}))
+
+			hostVeth, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			vlans, err := netlink.BridgeVlanList()
+			Expect(err).NotTo(HaveOccurred())
+
+			vids := map[uint16]*nl.BridgeVlanInfo{}
+			for _, info := range vlans[int32(hostVeth.Attrs().Index)] {
+				vids[info.Vid] = info
+			}
+			Expect(vids).To(HaveLen(5))
+			Expect(vids).NotTo(HaveKey(uint16(1)))
+			Expect(vids[100].PortVID()).To(BeTrue())
+			Expect(vids[100].EngressUntag()).To(BeTrue())
+			for _, vid := range []uint16{200, 300, 301, 302} {
+				Expect(vids).To(HaveKey(vid))
+				Expect(vids[vid].PortVID()).To(BeFalse())
+				Expect(vids[vid].EngressUntag()).To(BeFalse())
+			}
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects invalid VLAN configurations", func() {
+		for conf, msg := range map[string]string{
+			`"vlan": 4095`:                                     "invalid VLAN ID 4095 (must be between 0 and 4094)",
+			`"vlanTrunk": [{"id": 0}]`:                         "invalid VLAN ID 0 in vlanTrunk (must be between 1 and 4094)",
+			`"vlanTrunk": [{"minID": 20, "maxID": 10}]`:        "invalid vlanTrunk range: minID 20 is greater than maxID 10",
+			`"vlanTrunk": [{"minID": 10}]`:                     "invalid vlanTrunk entry: either id, or both minID and maxID must be set",
+			`"vlanTrunk": [{"id": 5, "minID": 1, "maxID": 9}]`: "invalid vlanTrunk entry: either id, or both minID and maxID must be set",
+		} {
+			_, _, err := loadNetConf([]byte(`{"cniVersion": "0.3.1", "name": "test", "type": "bridge", ` + conf + `}`))
+			Expect(err).To(MatchError(msg))
+		}
+
+		err := cmdAdd(&skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      "eth0",
+			StdinData:   []byte(`{"cniVersion": "0.3.1", "name": "test", "type": "bridge", "isGateway": true, "vlan": 100}`),
+		})
+		Expect(err).To(MatchError("cannot set isGateway together with vlan"))
+	})
+
+	It("attaches an uplink and moves its addresses and routes to the bridge", func() {
+		const UPLINK = "uplink0"
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			mac, err := net.ParseMAC("02:00:00:00:00:01")
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: UPLINK, HardwareAddr: mac},
+				PeerName:  "peer0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			uplink, err := netlink.LinkByName(UPLINK)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+			peer, err := netlink.LinkByName("peer0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(peer)).To(Succeed())
+
+			addr, err := netlink.ParseAddr("192.168.77.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: uplink.Attrs().Index,
+				Gw:        net.ParseIP("192.168.77.1"),
+			})).To(Succeed())
+
+			conf := testCase{cniVersion: "0.3.1"}.netConf()
+			conf.Uplink = UPLINK
+
+			// Running it twice must leave the same setup
+			for i := 0; i < 2; i++ {
+				br, brInterface, err := setupBridge(conf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(brInterface.Mac).To(Equal(mac.String()))
+
+				uplink, err = netlink.LinkByName(UPLINK)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(uplink.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+
+				addrs, err := netlink.AddrList(uplink, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(BeEmpty())
+				addrs, err = netlink.AddrList(br, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				Expect(addrs[0].IPNet.String()).To(Equal("192.168.77.2/24"))
+
+				routes, err := netlink.RouteList(br, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				var defaultRoute *netlink.Route
+				for i := range routes {
+					if routes[i].Dst == nil {
+						defaultRoute = &routes[i]
+					}
+				}
+				Expect(defaultRoute).NotTo(BeNil())
+				Expect(defaultRoute.Gw.String()).To(Equal("192.168.77.1"))
+			}
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("finishes moving the addresses of an uplink that is already attached", func() {
+		const UPLINK = "uplink0"
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			conf := testCase{cniVersion: "0.3.1"}.netConf()
+			br, _, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+
+			// An earlier ADD attached the uplink, but failed to move
+			// its address and default route
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: UPLINK},
+				PeerName:  "peer0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			uplink, err := netlink.LinkByName(UPLINK)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+			peer, err := netlink.LinkByName("peer0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(peer)).To(Succeed())
+			addr, err := netlink.ParseAddr("192.168.77.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: uplink.Attrs().Index,
+				Gw:        net.ParseIP("192.168.77.1"),
+			})).To(Succeed())
+			Expect(netlink.LinkSetMaster(uplink, br)).To(Succeed())
+
+			conf.Uplink = UPLINK
+			br, _, err = setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+
+			addrs, err := netlink.AddrList(uplink, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			addrs, err = netlink.AddrList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("192.168.77.2/24"))
+
+			routes, err := netlink.RouteList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			var defaultRoute *netlink.Route
+			for i := range routes {
+				if routes[i].Dst == nil {
+					defaultRoute = &routes[i]
+				}
+			}
+			Expect(defaultRoute).NotTo(BeNil())
+			Expect(defaultRoute.Gw.String()).To(Equal("192.168.77.1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("refuses an uplink attached to another master", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			other, err := ensureBridge("other0", 0, false, false)
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "peer0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetMaster(uplink, other)).To(Succeed())
+
+			conf := testCase{cniVersion: "0.3.1"}.netConf()
+			conf.Uplink = "uplink0"
+			_, _, err = setupBridge(conf)
+			Expect(err).To(MatchError(`uplink "uplink0" is already attached to another master`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("isolates the host veth with ADD", func() {
+		const IFNAME = "eth0"
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "%s",
+	"isolation": true,
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			hostVeth, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			isolated, err := getBridgePortAttr(hostVeth, iflaBrportIsolated)
+			Expect(err).NotTo(HaveOccurred())
+			if isolated == nil {
+				Skip("isolated bridge ports are not supported")
+			}
+			Expect(isolated).To(Equal([]byte{1}))
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("deletes the bridge with the DEL of the last container", func() {
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "%s",
+	"isGateway": true,
+	"deleteBridgeWhenEmpty": true,
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`, BRNAME)
+
+		var argsList []*skel.CmdArgs
+		for _, id := range []string{"first", "second"} {
+			targetNS, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNS.Close()
+			argsList = append(argsList, &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       targetNS.Path(),
+				IfName:      "eth0",
+				StdinData:   []byte(conf),
+			})
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, args := range argsList {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			err := testutils.CmdDelWithArgs(argsList[0], func() error {
+				return cmdDel(argsList[0])
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithArgs(argsList[1], func() error {
+				return cmdDel(argsList[1])
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(BRNAME)
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+
+			// DEL must also work if the bridge is gone already
+			return testutils.CmdDelWithArgs(argsList[1], func() error {
+				return cmdDel(argsList[1])
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("derives the MTU from a host interface with mtu auto", func() {
+		const IFNAME = "eth0"
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "%s",
+	"mtu": "auto",
+	"mtuInterface": "uplink0",
+	"mtuOverhead": 50,
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0", MTU: 1450},
+				PeerName:  "peer0",
+			})).To(Succeed())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(br.Attrs().MTU).To(Equal(1400))
+			hostVeth, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostVeth.Attrs().MTU).To(Equal(1400))
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().MTU).To(Equal(1400))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("applies the multicast and STP options to new and existing bridges", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			on, off := true, false
+			forwardDelay, ageingTime := 4, 120
+
+			conf := testCase{cniVersion: "0.3.1"}.netConf()
+			conf.McastSnooping = &off
+			conf.McastQuerier = &on
+			conf.STP = &on
+			conf.ForwardDelay = &forwardDelay
+			conf.AgeingTime = &ageingTime
+
+			expect := func(attrType int, value []byte) {
+				br, err := netlink.LinkByName(BRNAME)
+				Expect(err).NotTo(HaveOccurred())
+				attr, err := getBridgeAttr(br, attrType)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(attr).To(Equal(value))
+			}
+
+			_, _, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+			expect(nl.IFLA_BR_MCAST_SNOOPING, []byte{0})
+			expect(nl.IFLA_BR_MCAST_QUERIER, []byte{1})
+			expect(nl.IFLA_BR_STP_STATE, nl.Uint32Attr(1))
+			expect(nl.IFLA_BR_FORWARD_DELAY, nl.Uint32Attr(400))
+			expect(nl.IFLA_BR_AGEING_TIME, nl.Uint32Attr(12000))
+
+			// Options that are not set leave the existing bridge alone
+			conf = testCase{cniVersion: "0.3.1"}.netConf()
+			conf.STP = &off
+			_, _, err = setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+			expect(nl.IFLA_BR_STP_STATE, nl.Uint32Attr(0))
+			expect(nl.IFLA_BR_MCAST_SNOOPING, []byte{0})
+			expect(nl.IFLA_BR_AGEING_TIME, nl.Uint32Attr(12000))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects an invalid forward delay", func() {
+		_, _, err := loadNetConf([]byte(`{"cniVersion": "0.3.1", "name": "test", "type": "bridge", "forwardDelay": 1}`))
+		Expect(err).To(MatchError("invalid forwardDelay 1 (must be between 2 and 30 seconds)"))
+	})
+	It("adds a permanent neighbor entry for the gateway with staticGatewayNeighbor", func() {
+		const IFNAME = "eth0"
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "%s",
+	"isGateway": true,
+	"staticGatewayNeighbor": true,
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces[0].Mac).To(Equal(br.Attrs().HardwareAddr.String()))
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(neighs).To(HaveLen(1))
+				Expect(neighs[0].IP.String()).To(Equal(result.IPs[0].Gateway.String()))
+				Expect(neighs[0].HardwareAddr).To(Equal(br.Attrs().HardwareAddr))
+				Expect(neighs[0].State).To(Equal(netlink.NUD_PERMANENT))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("sets the MAC address requested in CNI_ARGS with ADD", func() {
+		const IFNAME = "eth0"
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "%s",
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "IgnoreUnknown=1;MAC=0a:58:0a:01:02:0a",
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces[2].Mac).To(Equal("0a:58:0a:01:02:0a"))
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().HardwareAddr.String()).To(Equal("0a:58:0a:01:02:0a"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects an invalid macFrom", func() {
+		_, _, err := loadNetConf([]byte(`{"cniVersion": "0.3.1", "name": "test", "type": "bridge", "macFrom": "random"}`))
+		Expect(err).To(MatchError(`invalid macFrom "random" (must be "ip" or "containerID")`))
+	})
+	It("derives the MAC address from the IP address with macFrom ip", func() {
+		const IFNAME = "eth0"
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "%s",
+	"macFrom": "ip",
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			ip4 := result.IPs[0].Address.IP.To4()
+			mac := fmt.Sprintf("0a:58:%02x:%02x:%02x:%02x", ip4[0], ip4[1], ip4[2], ip4[3])
+			Expect(result.Interfaces[2].Mac).To(Equal(mac))
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().HardwareAddr.String()).To(Equal(mac))
+				Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
 })
@@ -0,0 +1,126 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// IFLA_BRPORT_ISOLATED is missing from the vendored netlink, it is
+	// available since Linux 4.18
+	iflaBrportIsolated = 33
+
+	// isolationChain holds the jumps to the isolation chains of the
+	// containers, so that the rules of all of them see every frame in order
+	isolationChain = "CNI-ISOLATION"
+	// isolationMark is set on frames from isolated ports
+	isolationMark = "0x1000000"
+)
+
+// isolationChainName returns the name of the ebtables chain of a container.
+// It differs from the chain of the spoof checks of the same container.
+func isolationChainName(network, containerID string) string {
+	return utils.FormatChainName("isolation:"+network, containerID)
+}
+
+// setupIsolation keeps the port from exchanging frames with other isolated
+// ports. Frames to and from the other ports still pass.
+func setupIsolation(port netlink.Link, chain string) error {
+	if err := setBridgePortAttr(port, iflaBrportIsolated, []byte{1}); err != nil {
+		return fmt.Errorf("failed to isolate %q: %v", port.Attrs().Name, err)
+	}
+	// Older kernels ignore the flag instead of rejecting it
+	value, err := getBridgePortAttr(port, iflaBrportIsolated)
+	if err != nil {
+		return fmt.Errorf("failed to read isolation of %q: %v", port.Attrs().Name, err)
+	}
+	if len(value) == 1 && value[0] == 1 {
+		return nil
+	}
+
+	e, err := newEbtables()
+	if err != nil {
+		return fmt.Errorf("kernel doesn't support isolated bridge ports: %v", err)
+	}
+	if err := e.removeChain(chain, []string{isolationChain}); err != nil {
+		return err
+	}
+	if err := e.ensureIsolationChain(); err != nil {
+		return err
+	}
+
+	// Frames from the port are marked and frames to the port are dropped
+	// if they have the mark. The jumps for frames from ports go first, so
+	// that a frame gets its mark before it is checked.
+	name := port.Attrs().Name
+	for _, rule := range isolationRules(name) {
+		if _, err := e.run(append([]string{"-A", chain}, rule...)...); err != nil {
+			return err
+		}
+	}
+	if _, err := e.run("-I", isolationChain, "1", "-i", name, "-j", chain); err != nil {
+		return err
+	}
+	_, err = e.run("-A", isolationChain, "-o", name, "-j", chain)
+	return err
+}
+
+// teardownIsolation removes the rules setupIsolation installed on kernels
+// without isolated bridge ports
+func teardownIsolation(chain string) error {
+	e, err := newEbtables()
+	if err != nil {
+		// Without ebtables, the kernel isolated the port
+		return nil
+	}
+	return e.removeChain(chain, []string{isolationChain})
+}
+
+// isolationRules returns the rules of the isolation chain of a port
+func isolationRules(port string) [][]string {
+	return [][]string{
+		{"-i", port, "-j", "mark", "--mark-or", isolationMark, "--mark-target", "RETURN"},
+		{"--mark", isolationMark + "/" + isolationMark, "-j", "DROP"},
+	}
+}
+
+// ensureIsolationChain creates the isolation chain and jumps to it from
+// FORWARD, unless they exist already
+func (e *ebtables) ensureIsolationChain() error {
+	out, err := e.run("-L")
+	if err != nil {
+		return err
+	}
+	if !hasChain(out, isolationChain) {
+		if _, err := e.run("-N", isolationChain, "-P", "RETURN"); err != nil {
+			return err
+		}
+	}
+
+	out, err = e.run("-L", "FORWARD")
+	if err != nil {
+		return err
+	}
+	if len(findJumps(out, isolationChain)) == 0 {
+		if _, err := e.run("-I", "FORWARD", "1", "-j", isolationChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
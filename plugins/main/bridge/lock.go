@@ -0,0 +1,43 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+var defaultLockDir = "/run/cni/bridge"
+
+// withBridgeLock runs f while holding the lock of the bridge. ADD holds it
+// until its veth is attached, so that DEL doesn't delete the bridge under it.
+func withBridgeLock(brName string, f func() error) error {
+	if err := os.MkdirAll(defaultLockDir, 0700); err != nil {
+		return fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	m, err := filemutex.New(filepath.Join(defaultLockDir, brName+".lock"))
+	if err != nil {
+		return fmt.Errorf("failed to open lock of %q: %v", brName, err)
+	}
+	defer m.Close()
+
+	if err := m.Lock(); err != nil {
+		return fmt.Errorf("failed to lock %q: %v", brName, err)
+	}
+	return f()
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// The anti-spoofing rules of a container live in an ebtables chain of the
+// filter table, which frames entering the bridge from the host veth jump to.
+
+// spoofCheckHooks are the built-in chains that frames from a port go through
+var spoofCheckHooks = []string{"INPUT", "FORWARD"}
+
+type ebtables struct {
+	path string
+}
+
+func newEbtables() (*ebtables, error) {
+	path, err := exec.LookPath("ebtables")
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate ebtables: %v", err)
+	}
+	return &ebtables{path: path}, nil
+}
+
+func (e *ebtables) run(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(e.path, append([]string{"--concurrent", "-t", "filter"}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("running ebtables %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// spoofCheckRules returns the rules of the chain of a container. Frames
+// that don't match a DROP rule return to the built-in chain.
+func spoofCheckRules(mac string, ips []*current.IPConfig, macSpoofChk, ipSpoofChk bool) [][]string {
+	rules := [][]string{}
+	if macSpoofChk {
+		rules = append(rules, []string{"-s", "!", mac, "-j", "DROP"})
+	}
+	if !ipSpoofChk {
+		return rules
+	}
+
+	hasV4, hasV6 := false, false
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() != nil {
+			hasV4 = true
+			addr := ipc.Address.IP.String()
+			rules = append(rules,
+				[]string{"-p", "IPv4", "--ip-src", addr, "-j", "RETURN"},
+				[]string{"-p", "ARP", "--arp-ip-src", addr, "-j", "RETURN"},
+			)
+		} else {
+			hasV6 = true
+			rules = append(rules, []string{"-p", "IPv6", "--ip6-src", ipc.Address.IP.String(), "-j", "RETURN"})
+		}
+	}
+	if hasV4 {
+		// DHCP requests are sent before there is an address
+		rules = append(rules, []string{"-p", "IPv4", "--ip-src", "0.0.0.0", "--ip-proto", "udp", "--ip-dport", "67", "-j", "RETURN"})
+	}
+	if hasV6 {
+		// Neighbor discovery uses the link-local and, during DAD, the
+		// unspecified address
+		rules = append(rules,
+			[]string{"-p", "IPv6", "--ip6-src", "fe80::/10", "-j", "RETURN"},
+			[]string{"-p", "IPv6", "--ip6-src", "::", "-j", "RETURN"},
+		)
+	}
+	rules = append(rules,
+		[]string{"-p", "IPv4", "-j", "DROP"},
+		[]string{"-p", "ARP", "-j", "DROP"},
+		[]string{"-p", "IPv6", "-j", "DROP"},
+	)
+	return rules
+}
+
+// setupSpoofCheck installs the anti-spoofing rules of the host veth
+func setupSpoofCheck(chain, hostIfName, mac string, ips []*current.IPConfig, macSpoofChk, ipSpoofChk bool) error {
+	e, err := newEbtables()
+	if err != nil {
+		return err
+	}
+
+	// Start over if ADD is run again
+	if err := e.removeChain(chain, spoofCheckHooks); err != nil {
+		return err
+	}
+
+	if _, err := e.run("-N", chain, "-P", "RETURN"); err != nil {
+		return err
+	}
+	for _, rule := range spoofCheckRules(mac, ips, macSpoofChk, ipSpoofChk) {
+		if _, err := e.run(append([]string{"-A", chain}, rule...)...); err != nil {
+			return err
+		}
+	}
+	for _, hook := range spoofCheckHooks {
+		if _, err := e.run("-A", hook, "-i", hostIfName, "-j", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownSpoofCheck removes the anti-spoofing rules of a container
+func teardownSpoofCheck(chain string) error {
+	e, err := newEbtables()
+	if err != nil {
+		return err
+	}
+	return e.removeChain(chain, spoofCheckHooks)
+}
+
+// removeChain deletes chain and the jumps to it from the given chains
+func (e *ebtables) removeChain(chain string, from []string) error {
+	for _, hook := range from {
+		out, err := e.run("-L", hook)
+		if err != nil {
+			return err
+		}
+		for _, rule := range findJumps(out, chain) {
+			if _, err := e.run(append([]string{"-D", hook}, rule...)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	out, err := e.run("-L")
+	if err != nil {
+		return err
+	}
+	if !hasChain(out, chain) {
+		return nil
+	}
+	if _, err := e.run("-F", chain); err != nil {
+		return err
+	}
+	_, err = e.run("-X", chain)
+	return err
+}
+
+// findJumps returns the rules of an `ebtables -L` listing that jump to chain
+func findJumps(listing, chain string) [][]string {
+	rules := [][]string{}
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		n := len(fields)
+		if n >= 2 && fields[n-2] == "-j" && fields[n-1] == chain {
+			rules = append(rules, fields)
+		}
+	}
+	return rules
+}
+
+// hasChain returns whether an `ebtables -L` listing contains chain
+func hasChain(listing, chain string) bool {
+	return strings.Contains(listing, "Bridge chain: "+chain+",")
+}
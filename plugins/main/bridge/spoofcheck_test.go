@@ -0,0 +1,78 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("spoof check", func() {
+	const mac = "0a:58:0a:01:02:03"
+
+	ipConfig := func(addr string) *current.IPConfig {
+		ip, ipn, err := net.ParseCIDR(addr)
+		Expect(err).NotTo(HaveOccurred())
+		ipn.IP = ip
+		return &current.IPConfig{Address: *ipn}
+	}
+
+	It("only checks the MAC address with macspoofchk", func() {
+		rules := spoofCheckRules(mac, []*current.IPConfig{ipConfig("10.1.2.3/24")}, true, false)
+		Expect(rules).To(Equal([][]string{
+			{"-s", "!", mac, "-j", "DROP"},
+		}))
+	})
+
+	It("only allows the addresses of the result with ipspoofchk", func() {
+		ips := []*current.IPConfig{ipConfig("10.1.2.3/24"), ipConfig("2001:db8::3/64")}
+		rules := spoofCheckRules(mac, ips, true, true)
+		Expect(rules).To(Equal([][]string{
+			{"-s", "!", mac, "-j", "DROP"},
+			{"-p", "IPv4", "--ip-src", "10.1.2.3", "-j", "RETURN"},
+			{"-p", "ARP", "--arp-ip-src", "10.1.2.3", "-j", "RETURN"},
+			{"-p", "IPv6", "--ip6-src", "2001:db8::3", "-j", "RETURN"},
+			{"-p", "IPv4", "--ip-src", "0.0.0.0", "--ip-proto", "udp", "--ip-dport", "67", "-j", "RETURN"},
+			{"-p", "IPv6", "--ip6-src", "fe80::/10", "-j", "RETURN"},
+			{"-p", "IPv6", "--ip6-src", "::", "-j", "RETURN"},
+			{"-p", "IPv4", "-j", "DROP"},
+			{"-p", "ARP", "-j", "DROP"},
+			{"-p", "IPv6", "-j", "DROP"},
+		}))
+	})
+
+	It("finds the rules that jump to a chain", func() {
+		listing := `Bridge table: filter
+
+Bridge chain: FORWARD, entries: 3, policy: ACCEPT
+-i veth1234 -j CNI-0123456789abcdef01234567
+-i veth5678 -j CNI-fedcba9876543210fedcba98
+-i veth1234 -j CNI-0123456789abcdef01234567
+
+Bridge chain: CNI-0123456789abcdef01234567, entries: 1, policy: RETURN
+-s ! a:58:a:1:2:3 -j DROP
+`
+		Expect(findJumps(listing, "CNI-0123456789abcdef01234567")).To(Equal([][]string{
+			{"-i", "veth1234", "-j", "CNI-0123456789abcdef01234567"},
+			{"-i", "veth1234", "-j", "CNI-0123456789abcdef01234567"},
+		}))
+		Expect(hasChain(listing, "CNI-0123456789abcdef01234567")).To(BeTrue())
+		Expect(hasChain(listing, "CNI-fedcba9876543210fedcba98")).To(BeFalse())
+	})
+})
@@ -0,0 +1,127 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ensureUplink attaches a host interface to the bridge, moving its
+// addresses and gateway routes onto the bridge. For an uplink that is
+// already attached, whatever an earlier, interrupted run left on it is
+// moved.
+func ensureUplink(br *netlink.Bridge, uplinkName string, vlan int, trunk []int) error {
+	uplink, err := netlink.LinkByName(uplinkName)
+	if err != nil {
+		return fmt.Errorf("could not lookup uplink %q: %v", uplinkName, err)
+	}
+
+	master := uplink.Attrs().MasterIndex
+	if master != 0 && master != br.Attrs().Index {
+		return fmt.Errorf("uplink %q is already attached to another master", uplinkName)
+	}
+
+	if master == 0 {
+		if err := attachUplink(br, uplink); err != nil {
+			return err
+		}
+	}
+	if err := moveUplinkAddrs(br, uplink); err != nil {
+		return err
+	}
+
+	// The uplink passes the traffic of all VLANs of the network tagged
+	vlans := trunk
+	if vlan != 0 {
+		vlans = append([]int{vlan}, trunk...)
+	}
+	for _, id := range vlans {
+		if err := netlink.BridgeVlanAdd(uplink, uint16(id), false, false, false, false); err != nil {
+			return fmt.Errorf("failed to add VLAN %d to uplink %q: %v", id, uplinkName, err)
+		}
+	}
+
+	return nil
+}
+
+func attachUplink(br *netlink.Bridge, uplink netlink.Link) error {
+	name := uplink.Attrs().Name
+
+	// Keep the address of the host on the LAN, so that neighbors and
+	// DHCP servers still recognize it
+	if err := netlink.LinkSetHardwareAddr(br, uplink.Attrs().HardwareAddr); err != nil {
+		return fmt.Errorf("failed to set MAC address of %q: %v", br.Attrs().Name, err)
+	}
+
+	if err := netlink.LinkSetMaster(uplink, br); err != nil {
+		return fmt.Errorf("failed to attach uplink %q to %q: %v", name, br.Attrs().Name, err)
+	}
+	if err := netlink.LinkSetUp(uplink); err != nil {
+		return fmt.Errorf("failed to set uplink %q up: %v", name, err)
+	}
+	return nil
+}
+
+// moveUplinkAddrs moves the addresses and gateway routes of the uplink to
+// the bridge. The addresses are only removed from the uplink once the
+// bridge has them and the routes, so running it again after a failure
+// finishes the move.
+func moveUplinkAddrs(br *netlink.Bridge, uplink netlink.Link) error {
+	name := uplink.Attrs().Name
+
+	addrs, err := netlink.AddrList(uplink, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of uplink %q: %v", name, err)
+	}
+	// Routes through the uplink go away with its addresses, so read them
+	// first. Subnet routes are recreated by the kernel with the addresses.
+	routes, err := netlink.RouteList(uplink, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of uplink %q: %v", name, err)
+	}
+
+	var moved []netlink.Addr
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addr.Label = ""
+		if err := netlink.AddrAdd(br, &addr); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add address %v to %q: %v", addr.IPNet, br.Attrs().Name, err)
+		}
+		moved = append(moved, addr)
+	}
+
+	for _, route := range routes {
+		if route.Gw == nil {
+			continue
+		}
+		route.LinkIndex = br.Attrs().Index
+		if err := netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("failed to move route %v to %q: %v", route, br.Attrs().Name, err)
+		}
+	}
+
+	for _, addr := range moved {
+		if err := netlink.AddrDel(uplink, &addr); err != nil {
+			return fmt.Errorf("failed to remove address %v from uplink %q: %v", addr.IPNet, name, err)
+		}
+	}
+
+	return nil
+}
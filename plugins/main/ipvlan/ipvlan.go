@@ -27,6 +27,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
 	"github.com/vishvananda/netlink"
 )
 
@@ -41,6 +42,13 @@ type NetConf struct {
 	Master string `json:"master"`
 	Mode   string `json:"mode"`
 	MTU    int    `json:"mtu"`
+
+	// ipvlan interfaces share the MAC address of their master, so these
+	// are only there to reject requests for another one
+	MACFrom       string `json:"macFrom,omitempty"`
+	RuntimeConfig struct {
+		MAC string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
 }
 
 func init() {
@@ -161,6 +169,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	mac, err := hwaddr.RequestedMAC(n.RuntimeConfig.MAC, args.Args)
+	if err != nil {
+		return err
+	}
+	if mac != nil || n.MACFrom != "" {
+		return fmt.Errorf("cannot set the MAC address of an ipvlan interface, it shares the one of master %q", n.Master)
+	}
+
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
 		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
@@ -28,6 +28,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
@@ -42,6 +43,11 @@ type NetConf struct {
 	Master string `json:"master"`
 	Mode   string `json:"mode"`
 	MTU    int    `json:"mtu"`
+
+	MACFrom       string `json:"macFrom,omitempty"`
+	RuntimeConfig struct {
+		MAC string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
 }
 
 func init() {
@@ -59,6 +65,9 @@ func loadConf(bytes []byte) (*NetConf, string, error) {
 	if n.Master == "" {
 		return nil, "", fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 	}
+	if err := hwaddr.ValidateMACFrom(n.MACFrom); err != nil {
+		return nil, "", err
+	}
 	return n, n.CNIVersion, nil
 }
 
@@ -199,7 +208,24 @@ func cmdAdd(args *skel.CmdArgs) error {
 		ipc.Interface = current.Int(0)
 	}
 
+	mac, err := hwaddr.ResolveMAC(n.RuntimeConfig.MAC, args.Args, n.MACFrom, args.ContainerID, result.IPs)
+	if err != nil {
+		return err
+	}
+
 	err = netns.Do(func(_ ns.NetNS) error {
+		// Set the MAC address while the interface is still down
+		if mac != nil {
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+			}
+			if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+				return fmt.Errorf("failed to set MAC address of %q to %v: %v", args.IfName, mac, err)
+			}
+			macvlanInterface.Mac = mac.String()
+		}
+
 		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
 			return err
 		}
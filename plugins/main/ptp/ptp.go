@@ -30,6 +30,8 @@ import (
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 )
@@ -43,11 +45,36 @@ func init() {
 
 type NetConf struct {
 	types.NetConf
-	IPMasq bool `json:"ipMasq"`
-	MTU    int  `json:"mtu"`
+	IPMasq                bool     `json:"ipMasq"`
+	MTU                   ip.MTU   `json:"mtu"`
+	NonMasqueradeCIDRs    []string `json:"nonMasqueradeCIDRs,omitempty"`
+	SNATIP                string   `json:"snatIP,omitempty"`
+	IPMasqShared          bool     `json:"ipMasqShared"`
+	MTUInterface          string   `json:"mtuInterface,omitempty"`
+	MTUOverhead           int      `json:"mtuOverhead,omitempty"`
+	LinkLocalGateway      bool     `json:"linkLocalGateway"`
+	StaticGatewayNeighbor bool     `json:"staticGatewayNeighbor"`
+	MACFrom               string   `json:"macFrom,omitempty"`
+	RuntimeConfig         struct {
+		MAC string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
 }
 
-func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Result) (*current.Interface, *current.Interface, error) {
+// The next hops of the containers in link-local gateway mode. The host veth
+// answers for them with proxy ARP and proxy NDP.
+var (
+	linkLocalGatewayV4 = net.IPv4(169, 254, 1, 1)
+	linkLocalGatewayV6 = net.ParseIP("fe80::1")
+)
+
+func linkLocalGateway(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return linkLocalGatewayV4
+	}
+	return linkLocalGatewayV6
+}
+
+func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, mac net.HardwareAddr, pr *current.Result, linkLocal bool) (*current.Interface, *current.Interface, error) {
 	// The IPAM result will be something like IP=192.168.3.5/24, GW=192.168.3.1.
 	// What we want is really a point-to-point link but veth does not support IFF_POINTTOPOINT.
 	// Next best thing would be to let it ARP but set interface to 192.168.3.5/32 and
@@ -59,11 +86,15 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 	// "192.168.3.1/32 dev $ifName" and "192.168.3.0/24 via 192.168.3.1 dev $ifName".
 	// In other words we force all traffic to ARP via the gateway except for GW itself.
 
+	// In link-local gateway mode, the gateway is 169.254.1.1 or fe80::1
+	// instead, which is not in the subnet, so the routes of the result can
+	// only be added once the route to the gateway exists.
+
 	hostInterface := &current.Interface{}
 	containerInterface := &current.Interface{}
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, contVeth0, err := ip.SetupVethWithMAC(ifName, mtu, mac, hostNS)
 		if err != nil {
 			return err
 		}
@@ -80,7 +111,17 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 
 		pr.Interfaces = []*current.Interface{hostInterface, containerInterface}
 
-		if err = ipam.ConfigureIface(ifName, pr); err != nil {
+		ifaceResult := pr
+		if linkLocal {
+			for _, ipc := range pr.IPs {
+				ipc.Gateway = linkLocalGateway(ipc.Address.IP)
+			}
+			noRoutes := *pr
+			noRoutes.Routes = nil
+			ifaceResult = &noRoutes
+		}
+
+		if err = ipam.ConfigureIface(ifName, ifaceResult); err != nil {
 			return err
 		}
 
@@ -89,6 +130,7 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 			return fmt.Errorf("failed to look up %q: %v", ifName, err)
 		}
 
+		gatewayRoutes := map[string]bool{}
 		for _, ipc := range pr.IPs {
 			// Delete the route that was automatically added
 			route := netlink.Route{
@@ -109,8 +151,11 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 				addrBits = 128
 			}
 
-			for _, r := range []netlink.Route{
-				netlink.Route{
+			routes := []netlink.Route{}
+			// Addresses of the same family share the link-local gateway
+			if !gatewayRoutes[ipc.Gateway.String()] {
+				gatewayRoutes[ipc.Gateway.String()] = true
+				routes = append(routes, netlink.Route{
 					LinkIndex: contVeth.Index,
 					Dst: &net.IPNet{
 						IP:   ipc.Gateway,
@@ -118,24 +163,43 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 					},
 					Scope: netlink.SCOPE_LINK,
 					Src:   ipc.Address.IP,
+				})
+			}
+			routes = append(routes, netlink.Route{
+				LinkIndex: contVeth.Index,
+				Dst: &net.IPNet{
+					IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
+					Mask: ipc.Address.Mask,
 				},
-				netlink.Route{
-					LinkIndex: contVeth.Index,
-					Dst: &net.IPNet{
-						IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
-						Mask: ipc.Address.Mask,
-					},
-					Scope: netlink.SCOPE_UNIVERSE,
-					Gw:    ipc.Gateway,
-					Src:   ipc.Address.IP,
-				},
-			} {
+				Scope: netlink.SCOPE_UNIVERSE,
+				Gw:    ipc.Gateway,
+				Src:   ipc.Address.IP,
+			})
+
+			for _, r := range routes {
 				if err := netlink.RouteAdd(&r); err != nil {
 					return fmt.Errorf("failed to add route %v: %v", r, err)
 				}
 			}
 		}
 
+		if linkLocal {
+			for _, r := range pr.Routes {
+				gw := r.GW
+				if gw == nil {
+					gw = linkLocalGateway(r.Dst.IP)
+				}
+				route := netlink.Route{
+					LinkIndex: contVeth.Index,
+					Dst:       &r.Dst,
+					Gw:        gw,
+				}
+				if err := netlink.RouteAdd(&route); err != nil {
+					return fmt.Errorf("failed to add route %v: %v", route, err)
+				}
+			}
+		}
+
 		// Send a gratuitous arp for all v4 addresses
 		for _, ipc := range pr.IPs {
 			if ipc.Version == "4" {
@@ -151,29 +215,37 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 	return hostInterface, containerInterface, nil
 }
 
-func setupHostVeth(vethName string, result *current.Result) error {
+func setupHostVeth(vethName string, result *current.Result, linkLocal bool) error {
 	// hostVeth moved namespaces and may have a new ifindex
 	veth, err := netlink.LinkByName(vethName)
 	if err != nil {
 		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
 	}
 
+	if linkLocal {
+		if err := setupLinkLocalGateway(veth, result); err != nil {
+			return err
+		}
+	}
+
 	for _, ipc := range result.IPs {
 		maskLen := 128
 		if ipc.Address.IP.To4() != nil {
 			maskLen = 32
 		}
 
-		ipn := &net.IPNet{
-			IP:   ipc.Gateway,
-			Mask: net.CIDRMask(maskLen, maskLen),
-		}
-		addr := &netlink.Addr{IPNet: ipn, Label: ""}
-		if err = netlink.AddrAdd(veth, addr); err != nil {
-			return fmt.Errorf("failed to add IP addr (%#v) to veth: %v", ipn, err)
+		if !linkLocal {
+			ipn := &net.IPNet{
+				IP:   ipc.Gateway,
+				Mask: net.CIDRMask(maskLen, maskLen),
+			}
+			addr := &netlink.Addr{IPNet: ipn, Label: ""}
+			if err = netlink.AddrAdd(veth, addr); err != nil {
+				return fmt.Errorf("failed to add IP addr (%#v) to veth: %v", ipn, err)
+			}
 		}
 
-		ipn = &net.IPNet{
+		ipn := &net.IPNet{
 			IP:   ipc.Address.IP,
 			Mask: net.CIDRMask(maskLen, maskLen),
 		}
@@ -186,11 +258,50 @@ func setupHostVeth(vethName string, result *current.Result) error {
 	return nil
 }
 
+// setupLinkLocalGateway makes the host veth answer for the link-local
+// gateway of the container
+func setupLinkLocalGateway(veth netlink.Link, result *current.Result) error {
+	name := veth.Attrs().Name
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil {
+			if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", name), "1"); err != nil {
+				return fmt.Errorf("failed to enable proxy ARP on %q: %v", name, err)
+			}
+			continue
+		}
+
+		if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", name), "1"); err != nil {
+			return fmt.Errorf("failed to enable proxy NDP on %q: %v", name, err)
+		}
+		neigh := &netlink.Neigh{
+			LinkIndex: veth.Attrs().Index,
+			Family:    netlink.FAMILY_V6,
+			Flags:     netlink.NTF_PROXY,
+			IP:        linkLocalGatewayV6,
+		}
+		if err := netlink.NeighSet(neigh); err != nil {
+			return fmt.Errorf("failed to add proxy neighbor %v on %q: %v", linkLocalGatewayV6, name, err)
+		}
+	}
+	return nil
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 	conf := NetConf{}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
+	ipMasqOptions, err := ip.ParseIPMasqOptions(conf.NonMasqueradeCIDRs, conf.SNATIP)
+	if err != nil {
+		return err
+	}
+	mtu, err := ip.ResolveMTU(conf.MTU, conf.MTUInterface, conf.MTUOverhead)
+	if err != nil {
+		return err
+	}
+	if err := hwaddr.ValidateMACFrom(conf.MACFrom); err != nil {
+		return err
+	}
 
 	// run the IPAM plugin and get back the config to apply
 	r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
@@ -207,6 +318,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return errors.New("IPAM plugin returned missing IP config")
 	}
 
+	mac, err := hwaddr.ResolveMAC(conf.RuntimeConfig.MAC, args.Args, conf.MACFrom, args.ContainerID, result.IPs)
+	if err != nil {
+		return err
+	}
+
 	if err := ip.EnableForward(result.IPs); err != nil {
 		return fmt.Errorf("Could not enable IP forwarding: %v", err)
 	}
@@ -217,20 +333,42 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	hostInterface, containerInterface, err := setupContainerVeth(netns, args.IfName, conf.MTU, result)
+	hostInterface, containerInterface, err := setupContainerVeth(netns, args.IfName, mtu, mac, result, conf.LinkLocalGateway)
 	if err != nil {
 		return err
 	}
 
-	if err = setupHostVeth(hostInterface.Name, result); err != nil {
+	if err = setupHostVeth(hostInterface.Name, result, conf.LinkLocalGateway); err != nil {
 		return err
 	}
 
-	if conf.IPMasq {
+	if conf.StaticGatewayNeighbor {
+		// The host veth is the gateway of every IP configuration
+		hwAddr, err := net.ParseMAC(hostInterface.Mac)
+		if err != nil {
+			return fmt.Errorf("failed to parse MAC address of %q: %v", hostInterface.Name, err)
+		}
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureGatewayNeighbors(args.IfName, result, hwAddr)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.IPMasq && conf.IPMasqShared {
+		chain := utils.FormatChainName(conf.Name, "")
+		comment := utils.FormatNetworkComment(conf.Name)
+		for _, ipc := range result.IPs {
+			if err = ip.SetupIPMasqShared(&ipc.Address, chain, comment, ipMasqOptions); err != nil {
+				return err
+			}
+		}
+	} else if conf.IPMasq {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
 		for _, ipc := range result.IPs {
-			if err = ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
+			if err = ip.SetupIPMasqWithOptions(&ipc.Address, chain, comment, ipMasqOptions); err != nil {
 				return err
 			}
 		}
@@ -277,7 +415,12 @@ func cmdDel(args *skel.CmdArgs) error {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
 		for _, ipn := range ipnets {
+			// Containers added before the network switched to the shared
+			// chain still have a chain of their own
 			err = ip.TeardownIPMasq(ipn, chain, comment)
+			if err == nil && conf.IPMasqShared {
+				err = ip.TeardownIPMasqShared(ipn, utils.FormatChainName(conf.Name, ""))
+			}
 		}
 	}
 
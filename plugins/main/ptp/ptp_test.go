@@ -22,6 +22,8 @@ import (
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 
 	"github.com/vishvananda/netlink"
 
@@ -215,4 +217,223 @@ var _ = Describe("ptp Operations", func() {
 		})
 		Expect(err).NotTo(HaveOccurred())
 	})
+
+	It("routes through a link-local gateway with linkLocalGateway", func() {
+		const IFNAME = "ptp0"
+
+		conf := `{
+    "cniVersion": "0.3.1",
+    "name": "mynet",
+    "type": "ptp",
+    "linkLocalGateway": true,
+    "ipam": {
+        "type": "host-local",
+        "ranges": [
+            [{ "subnet": "10.1.2.0/24"}],
+            [{ "subnet": "2001:db8:1::0/66"}]
+        ],
+        "routes": [
+            {"dst": "0.0.0.0/0"},
+            {"dst": "::/0"}
+        ]
+    }
+}`
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			resI, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			res, err := current.GetResult(resI)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.IPs).To(HaveLen(2))
+			Expect(res.IPs[0].Gateway.String()).To(Equal("169.254.1.1"))
+			Expect(res.IPs[1].Gateway.String()).To(Equal("fe80::1"))
+
+			// The host veth has no gateway address, but answers for it
+			hostVeth, err := netlink.LinkByName(res.Interfaces[0].Name)
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(hostVeth, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+
+			proxyARP, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", hostVeth.Attrs().Name))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxyARP).To(Equal("1"))
+			proxyNDP, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", hostVeth.Attrs().Name))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxyNDP).To(Equal("1"))
+			neighs, err := netlink.NeighProxyList(hostVeth.Attrs().Index, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(neighs).To(HaveLen(1))
+			Expect(neighs[0].IP.String()).To(Equal("fe80::1"))
+
+			err = targetNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+					routes, err := netlink.RouteList(link, family)
+					Expect(err).NotTo(HaveOccurred())
+					var defaultRoute *netlink.Route
+					for i := range routes {
+						if routes[i].Dst == nil {
+							defaultRoute = &routes[i]
+						}
+					}
+					Expect(defaultRoute).NotTo(BeNil())
+					if family == netlink.FAMILY_V4 {
+						Expect(defaultRoute.Gw.String()).To(Equal("169.254.1.1"))
+					} else {
+						Expect(defaultRoute.Gw.String()).To(Equal("fe80::1"))
+					}
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("adds permanent neighbor entries for the gateways with staticGatewayNeighbor", func() {
+		const IFNAME = "ptp0"
+
+		conf := `{
+    "cniVersion": "0.3.1",
+    "name": "mynet",
+    "type": "ptp",
+    "staticGatewayNeighbor": true,
+    "ipam": {
+        "type": "host-local",
+        "ranges": [
+            [{ "subnet": "10.1.2.0/24"}],
+            [{ "subnet": "2001:db8:1::0/66"}]
+        ]
+    }
+}`
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			resI, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			res, err := current.GetResult(resI)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.IPs).To(HaveLen(2))
+
+			err = targetNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				for _, ipc := range res.IPs {
+					family := netlink.FAMILY_V6
+					if ipc.Version == "4" {
+						family = netlink.FAMILY_V4
+					}
+					neighs, err := netlink.NeighList(link.Attrs().Index, family)
+					Expect(err).NotTo(HaveOccurred())
+					var found *netlink.Neigh
+					for i := range neighs {
+						if neighs[i].IP.Equal(ipc.Gateway) {
+							found = &neighs[i]
+						}
+					}
+					Expect(found).NotTo(BeNil())
+					Expect(found.State).To(Equal(netlink.NUD_PERMANENT))
+					Expect(found.HardwareAddr.String()).To(Equal(res.Interfaces[0].Mac))
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("derives the MAC address from the container ID with macFrom containerID", func() {
+		const IFNAME = "ptp0"
+
+		conf := `{
+    "cniVersion": "0.3.1",
+    "name": "mynet",
+    "type": "ptp",
+    "macFrom": "containerID",
+    "ipam": {
+        "type": "host-local",
+        "subnet": "10.1.2.0/24"
+    }
+}`
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		mac := hwaddr.GenerateHardwareAddrFromID("dummy").String()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			resI, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			res, err := current.GetResult(resI)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Interfaces[1].Mac).To(Equal(mac))
+
+			err = targetNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().HardwareAddr.String()).To(Equal(mac))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
 })
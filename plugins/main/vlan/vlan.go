@@ -27,6 +27,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
 	"github.com/vishvananda/netlink"
 )
 
@@ -35,6 +36,11 @@ type NetConf struct {
 	Master string `json:"master"`
 	VlanId int    `json:"vlanId"`
 	MTU    int    `json:"mtu,omitempty"`
+
+	MACFrom       string `json:"macFrom,omitempty"`
+	RuntimeConfig struct {
+		MAC string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
 }
 
 func init() {
@@ -55,6 +61,9 @@ func loadConf(bytes []byte) (*NetConf, string, error) {
 	if n.VlanId < 0 || n.VlanId > 4094 {
 		return nil, "", fmt.Errorf(`invalid VLAN ID %d (must be between 0 and 4095 inclusive)`, n.VlanId)
 	}
+	if err := hwaddr.ValidateMACFrom(n.MACFrom); err != nil {
+		return nil, "", err
+	}
 	return n, n.CNIVersion, nil
 }
 
@@ -153,7 +162,23 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result.Interfaces = []*current.Interface{vlanInterface}
 
+	mac, err := hwaddr.ResolveMAC(n.RuntimeConfig.MAC, args.Args, n.MACFrom, args.ContainerID, result.IPs)
+	if err != nil {
+		return err
+	}
+
 	err = netns.Do(func(_ ns.NetNS) error {
+		// Set the MAC address while the interface is still down
+		if mac != nil {
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+			}
+			if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+				return fmt.Errorf("failed to set MAC address of %q to %v: %v", args.IfName, mac, err)
+			}
+			vlanInterface.Mac = mac.String()
+		}
 		return ipam.ConfigureIface(args.IfName, result)
 	})
 	if err != nil {
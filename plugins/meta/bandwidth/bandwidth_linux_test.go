@@ -15,9 +15,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/vishvananda/netlink"
@@ -61,7 +64,7 @@ var _ = Describe("bandwidth test", func() {
 		hostIP = net.IP{169, 254, 0, 1}
 		containerIP = net.IP{10, 254, 0, 1}
 		hostIfaceMTU = 1024
-		ifbDeviceName = "5b6c"
+		ifbDeviceName = "bwp5b6c01234e97"
 
 		createVeth(hostNs.Path(), hostIfname, containerNs.Path(), containerIfname, hostIP, containerIP, hostIfaceMTU)
 	})
@@ -359,6 +362,353 @@ var _ = Describe("bandwidth test", func() {
 			})).To(Succeed())
 		})
 
+		It("Works with a Veth pair using htb", func() {
+			conf := `{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"shapingMode": "htb",
+	"unshapedSubnets": ["10.96.0.0/12", "fd00::/8"],
+	"ingressRate": 8000,
+	"ingressBurst": 8000,
+	"ingressCeil": 16000,
+	"egressRate": 8000,
+	"egressBurst": 8000,
+	"prevResult": {
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": ""
+			},
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			}
+		],
+		"routes": []
+	}
+}`
+
+			conf = fmt.Sprintf(conf, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				for _, name := range []string{hostIfname, ifbDeviceName} {
+					link, err := netlink.LinkByName(name)
+					Expect(err).NotTo(HaveOccurred())
+
+					qdiscs, err := netlink.QdiscList(link)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(qdiscs[0]).To(BeAssignableToTypeOf(&netlink.Htb{}))
+					Expect(qdiscs[0].(*netlink.Htb).Defcls).To(Equal(uint32(0x30)))
+
+					classes, err := netlink.ClassList(link, netlink.MakeHandle(1, 0))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(classes).To(HaveLen(3))
+
+					filters, err := netlink.FilterList(link, netlink.MakeHandle(1, 0))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(filters).To(HaveLen(2))
+					for _, f := range filters {
+						Expect(f.(*netlink.U32).ClassId).To(Equal(netlink.MakeHandle(1, 2)))
+					}
+				}
+
+				hostLink, err := netlink.LinkByName(hostIfname)
+				Expect(err).NotTo(HaveOccurred())
+				classes, err := netlink.ClassList(hostLink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				for _, c := range classes {
+					if c.Attrs().Handle == netlink.MakeHandle(1, 0x30) {
+						Expect(c.(*netlink.HtbClass).Rate).To(Equal(uint64(1000)))
+						Expect(c.(*netlink.HtbClass).Ceil).To(Equal(uint64(2000)))
+					}
+				}
+				return nil
+			})).To(Succeed())
+		})
+
+		It("Shapes the container interface when there is no host veth", func() {
+			conf := `{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"ingressRate": 8,
+	"ingressBurst": 8,
+	"egressRate": 16,
+	"egressBurst": 8,
+	"prevResult": {
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 0
+			}
+		],
+		"routes": []
+	}
+}`
+
+			conf = fmt.Sprintf(conf, containerIfname, containerNs.Path(), containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				r, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+				result, err := current.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(result.Interfaces).To(HaveLen(2))
+				Expect(result.Interfaces[1].Name).To(Equal(ifbDeviceName))
+				Expect(result.Interfaces[1].Sandbox).To(Equal(containerNs.Path()))
+
+				// nothing on the host
+				_, err = netlink.LinkByName(ifbDeviceName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})).To(Succeed())
+
+			Expect(containerNs.Do(func(n ns.NetNS) error {
+				defer GinkgoRecover()
+
+				ifbLink, err := netlink.LinkByName(ifbDeviceName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ifbLink.Attrs().MTU).To(Equal(hostIfaceMTU))
+
+				// traffic to the container is shaped on the ifb device
+				qdiscs, err := netlink.QdiscList(ifbLink)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(qdiscs).To(HaveLen(1))
+				Expect(qdiscs[0]).To(BeAssignableToTypeOf(&netlink.Tbf{}))
+				Expect(qdiscs[0].(*netlink.Tbf).Rate).To(Equal(uint64(1)))
+
+				// traffic from the container is shaped on its interface
+				containerLink, err := netlink.LinkByName(containerIfname)
+				Expect(err).NotTo(HaveOccurred())
+				qdiscs, err = netlink.QdiscList(containerLink)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(qdiscs).To(HaveLen(2))
+				Expect(qdiscs[0]).To(BeAssignableToTypeOf(&netlink.Tbf{}))
+				Expect(qdiscs[0].(*netlink.Tbf).Rate).To(Equal(uint64(2)))
+
+				filters, err := netlink.FilterList(containerLink, netlink.MakeHandle(0xffff, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filters).To(HaveLen(1))
+				Expect(filters[0].(*netlink.U32).Actions[0].(*netlink.MirredAction).Ifindex).To(Equal(ifbLink.Attrs().Index))
+				return nil
+			})).To(Succeed())
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				err := testutils.CmdDel(containerNs.Path(), args.ContainerID, "", func() error { return cmdDel(args) })
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})).To(Succeed())
+
+			Expect(containerNs.Do(func(n ns.NetNS) error {
+				defer GinkgoRecover()
+				_, err := netlink.LinkByName(ifbDeviceName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})).To(Succeed())
+		})
+
+		It("Converges to the new limits when ADD is run again", func() {
+			add := func(limits string) {
+				conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	%s
+	"prevResult": {
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": ""
+			},
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			}
+		],
+		"routes": []
+	}
+}`, limits, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       containerNs.Path(),
+					IfName:      containerIfname,
+					StdinData:   []byte(conf),
+				}
+				_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+			}
+
+			rootQdisc := func(name string) netlink.Qdisc {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				qdiscs, err := netlink.QdiscList(link)
+				Expect(err).NotTo(HaveOccurred())
+				for _, q := range qdiscs {
+					if q.Attrs().Parent == netlink.HANDLE_ROOT {
+						return q
+					}
+				}
+				return nil
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+
+				add(`"ingressRate": 8, "ingressBurst": 8, "egressRate": 16, "egressBurst": 8,`)
+				Expect(rootQdisc(hostIfname).(*netlink.Tbf).Rate).To(Equal(uint64(1)))
+				Expect(rootQdisc(ifbDeviceName).(*netlink.Tbf).Rate).To(Equal(uint64(2)))
+
+				add(`"ingressRate": 24, "ingressBurst": 24, "egressRate": 32, "egressBurst": 32,`)
+				Expect(rootQdisc(hostIfname).(*netlink.Tbf).Rate).To(Equal(uint64(3)))
+				Expect(rootQdisc(ifbDeviceName).(*netlink.Tbf).Rate).To(Equal(uint64(4)))
+
+				hostLink, err := netlink.LinkByName(hostIfname)
+				Expect(err).NotTo(HaveOccurred())
+				filters, err := netlink.FilterList(hostLink, netlink.MakeHandle(0xffff, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filters).To(HaveLen(1))
+
+				add(`"shapingMode": "htb", "unshapedSubnets": ["10.96.0.0/12"], "ingressRate": 8000, "ingressBurst": 8000, "egressRate": 8000, "egressBurst": 8000,`)
+				Expect(rootQdisc(hostIfname)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+				Expect(rootQdisc(ifbDeviceName)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+
+				add(`"shapingMode": "htb", "unshapedSubnets": ["10.96.0.0/12", "192.0.2.0/24"], "ingressRate": 16000, "ingressBurst": 8000,`)
+				classes, err := netlink.ClassList(hostLink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				for _, c := range classes {
+					if c.Attrs().Handle == netlink.MakeHandle(1, 0x30) {
+						Expect(c.(*netlink.HtbClass).Rate).To(Equal(uint64(2000)))
+					}
+				}
+				filters, err = netlink.FilterList(hostLink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filters).To(HaveLen(2))
+
+				// egress shaping was dropped
+				_, err = netlink.LinkByName(ifbDeviceName)
+				Expect(err).To(HaveOccurred())
+				filters, err = netlink.FilterList(hostLink, netlink.MakeHandle(0xffff, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filters).To(BeEmpty())
+
+				// without the ifb device, there is no telling whether
+				// the qdisc of the host veth is ours
+				add(`"ingressRate": 0, "ingressBurst": 0,`)
+				Expect(rootQdisc(hostIfname)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+
+				add(`"ingressRate": 8, "ingressBurst": 8, "egressRate": 16, "egressBurst": 8,`)
+				add(`"ingressRate": 0, "ingressBurst": 0,`)
+				_, err = netlink.LinkByName(ifbDeviceName)
+				Expect(err).To(HaveOccurred())
+				qdiscs, err := netlink.QdiscList(hostLink)
+				Expect(err).NotTo(HaveOccurred())
+				for _, q := range qdiscs {
+					Expect(q).NotTo(BeAssignableToTypeOf(&netlink.Tbf{}))
+					Expect(q).NotTo(BeAssignableToTypeOf(&netlink.Htb{}))
+					Expect(q).NotTo(BeAssignableToTypeOf(&netlink.Ingress{}))
+				}
+				return nil
+			})).To(Succeed())
+		})
+
+		It("Leaves the qdiscs alone without limits when it never shaped", func() {
+			conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"prevResult": {
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": ""
+			},
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			}
+		],
+		"routes": []
+	}
+}`, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+
+				// a qdisc someone else set up
+				hostLink, err := netlink.LinkByName(hostIfname)
+				Expect(err).NotTo(HaveOccurred())
+				opts := shapingOpts{mode: shapingModeTBF, latencyInMillis: defaultLatencyInMillis}
+				Expect(CreateIngressQdisc(8, 8, 0, hostIfname, ifbDeviceName, opts)).To(Succeed())
+
+				_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				qdiscs, err := netlink.QdiscList(hostLink)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(qdiscs).To(HaveLen(1))
+				Expect(qdiscs[0]).To(BeAssignableToTypeOf(&netlink.Tbf{}))
+				return nil
+			})).To(Succeed())
+		})
+
 		It("Works with a Veth pair using runtime config", func() {
 			conf := `{
 	"cniVersion": "0.3.0",
@@ -575,6 +925,271 @@ var _ = Describe("bandwidth test", func() {
 			})).To(Succeed())
 
 		})
+
+		It("Deletes the ifb device from prevResult using 0.4.0 config", func() {
+			conf := `{
+	"cniVersion": "0.4.0",
+	"name": "%s",
+	"type": "bandwidth",
+	"egressRate": 9,
+	"egressBurst": 9,
+	"prevResult": %s
+}`
+			prevResult := fmt.Sprintf(`{
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": ""
+			},
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			}
+		],
+		"routes": []
+	}`, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+
+			addConf := fmt.Sprintf(conf, "cni-plugin-bandwidth-test", prevResult)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(addConf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				r, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(addConf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				_, err = netlink.LinkByName(ifbDeviceName)
+				Expect(err).NotTo(HaveOccurred())
+
+				// The network has been renamed since ADD
+				resultBytes, err := json.Marshal(r)
+				Expect(err).NotTo(HaveOccurred())
+				args.StdinData = []byte(fmt.Sprintf(conf, "renamed", string(resultBytes)))
+
+				err = testutils.CmdDel(containerNs.Path(), args.ContainerID, "", func() error { return cmdDel(args) })
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = netlink.LinkByName(ifbDeviceName)
+				Expect(err).To(HaveOccurred())
+
+				return nil
+			})).To(Succeed())
+		})
+		It("Deletes an ifb device created before the upgrade", func() {
+			// Older versions named the device after the first 4
+			// characters of the hash and only created it on the host
+			legacyIfbDeviceName := "5b6c"
+			conf := fmt.Sprintf(`{
+	"cniVersion": "0.4.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"egressRate": 9,
+	"egressBurst": 9,
+	"prevResult": {
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": ""
+			},
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			},
+			{
+				"name": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			}
+		],
+		"routes": []
+	}
+}`, hostIfname, containerIfname, containerNs.Path(), legacyIfbDeviceName, containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				Expect(CreateIfb(legacyIfbDeviceName, hostIfaceMTU)).To(Succeed())
+
+				err := testutils.CmdDel(containerNs.Path(), args.ContainerID, "", func() error { return cmdDel(args) })
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = netlink.LinkByName(legacyIfbDeviceName)
+				Expect(err).To(HaveOccurred())
+
+				// Also without a prevResult
+				Expect(CreateIfb(legacyIfbDeviceName, hostIfaceMTU)).To(Succeed())
+				args.StdinData = []byte(`{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth"
+}`)
+				err = testutils.CmdDel(containerNs.Path(), args.ContainerID, "", func() error { return cmdDel(args) })
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = netlink.LinkByName(legacyIfbDeviceName)
+				Expect(err).To(HaveOccurred())
+
+				return nil
+			})).To(Succeed())
+		})
+	})
+
+	Describe("stats", func() {
+		It("Reports the counters of the ingress and egress qdiscs", func() {
+			conf := `{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"ingressRate": 8,
+	"ingressBurst": 8,
+	"egressRate": 16,
+	"egressBurst": 8,
+	"prevResult": {
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": ""
+			},
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			}
+		],
+		"routes": []
+	}
+}`
+
+			conf = fmt.Sprintf(conf, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				var buf bytes.Buffer
+				err = runStats([]string{"-netns", containerNs.Path(), "-ifname", containerIfname, "cni-plugin-bandwidth-test", "dummy"}, &buf)
+				Expect(err).NotTo(HaveOccurred())
+
+				stats := &Stats{}
+				Expect(json.Unmarshal(buf.Bytes(), stats)).To(Succeed())
+				Expect(stats.Ingress).NotTo(BeNil())
+				Expect(stats.Ingress.Device).To(Equal(hostIfname))
+				Expect(stats.Ingress.Kind).To(Equal("tbf"))
+				Expect(stats.Egress).NotTo(BeNil())
+				Expect(stats.Egress.Device).To(Equal(ifbDeviceName))
+				Expect(stats.Egress.Kind).To(Equal("tbf"))
+
+				// Ingress traffic is not shaped without limits
+				conf = strings.Replace(conf, `"ingressRate": 8,`, `"ingressRate": 0,`, 1)
+				conf = strings.Replace(conf, `"ingressBurst": 8,`, `"ingressBurst": 0,`, 1)
+				args.StdinData = []byte(conf)
+				_, out, err = testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", args.StdinData, func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				stats, err = getStats("cni-plugin-bandwidth-test", "dummy", containerNs.Path(), containerIfname)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stats.Ingress).To(BeNil())
+				Expect(stats.Egress).NotTo(BeNil())
+
+				return nil
+			})).To(Succeed())
+		})
+
+		It("Reports the counters inside the netns when there is no host veth", func() {
+			conf := fmt.Sprintf(`{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"ingressRate": 8,
+	"ingressBurst": 8,
+	"egressRate": 16,
+	"egressBurst": 8,
+	"prevResult": {
+		"interfaces": [
+			{
+				"name": "%s",
+				"sandbox": "%s"
+			}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "%s/24",
+				"gateway": "10.0.0.1",
+				"interface": 0
+			}
+		],
+		"routes": []
+	}
+}`, containerIfname, containerNs.Path(), containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				stats, err := getStats("cni-plugin-bandwidth-test", "dummy", containerNs.Path(), containerIfname)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stats.Ingress).NotTo(BeNil())
+				Expect(stats.Ingress.Device).To(Equal(ifbDeviceName))
+				Expect(stats.Ingress.Kind).To(Equal("tbf"))
+				Expect(stats.Egress).NotTo(BeNil())
+				Expect(stats.Egress.Device).To(Equal(containerIfname))
+				Expect(stats.Egress.Kind).To(Equal("tbf"))
+
+				err = testutils.CmdDel(containerNs.Path(), args.ContainerID, "", func() error { return cmdDel(args) })
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})).To(Succeed())
+		})
+
+		It("Fails without a network namespace", func() {
+			err := runStats([]string{"cni-plugin-bandwidth-test", "dummy"}, &bytes.Buffer{})
+			Expect(err).To(MatchError("-netns is required"))
+		})
 	})
 
 	Context("when chaining bandwidth plugin with PTP using 0.3.0 config", func() {
@@ -725,3 +1340,99 @@ var _ = Describe("bandwidth test", func() {
 	})
 
 })
+
+var _ = Describe("bandwidth config", func() {
+	It("defaults to tbf with a 25ms latency", func() {
+		conf, err := parseConfig([]byte(`{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"ingressRate": 8,
+	"ingressBurst": 8
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.ShapingMode).To(Equal("tbf"))
+		Expect(conf.LatencyMs).To(Equal(25))
+	})
+
+	It("parses htb settings", func() {
+		conf, err := parseConfig([]byte(`{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"shapingMode": "htb",
+	"unshapedSubnets": ["10.96.0.0/12", "169.254.169.254/32"],
+	"egressRate": 8,
+	"egressBurst": 8,
+	"egressCeil": 16
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.EgressCeil).To(Equal(16))
+		opts := conf.shapingOpts()
+		Expect(opts.mode).To(Equal("htb"))
+		Expect(opts.unshapedSubnets).To(HaveLen(2))
+		Expect(opts.unshapedSubnets[0].String()).To(Equal("10.96.0.0/12"))
+	})
+
+	It("rejects invalid settings", func() {
+		for conf, msg := range map[string]string{
+			`"shapingMode": "cbq"`:                           `invalid shapingMode "cbq", must be "tbf" or "htb"`,
+			`"latencyMs": -1`:                                "latencyMs must be a positive integer",
+			`"unshapedSubnets": ["10.0.0.0/8"]`:              `unshapedSubnets requires shapingMode "htb"`,
+			`"shapingMode": "htb", "unshapedSubnets": ["x"]`: `invalid unshaped subnet "x": invalid CIDR address: x`,
+			`"ingressCeil": 16`:                              `ceil requires shapingMode "htb"`,
+			`"shapingMode": "htb", "ingressCeil": 4`:         "ceil must not be lower than rate",
+		} {
+			_, err := parseConfig([]byte(fmt.Sprintf(`{
+	"cniVersion": "0.3.0",
+	"name": "cni-plugin-bandwidth-test",
+	"type": "bandwidth",
+	"ingressRate": 8,
+	"ingressBurst": 8,
+	%s
+}`, conf)))
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("uses long ifb device names", func() {
+		name, err := getIfbDeviceName("cni-plugin-bandwidth-test", "dummy")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("bwp5b6c01234e97"))
+
+		legacyName, err := getLegacyIfbDeviceName("cni-plugin-bandwidth-test", "dummy")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(legacyName).To(Equal("5b6c"))
+
+		Expect(getIfbInterfaces(&current.Result{
+			Interfaces: []*current.Interface{
+				{Name: "bwp-veth"},
+				{Name: "eth0", Sandbox: "/var/run/netns/blue"},
+				{Name: name, Sandbox: "/var/run/netns/blue"},
+				{Name: legacyName},
+			},
+		}, legacyName)).To(Equal([]*current.Interface{
+			{Name: name, Sandbox: "/var/run/netns/blue"},
+			{Name: legacyName},
+		}))
+		Expect(getIfbInterfaces(nil, legacyName)).To(BeEmpty())
+	})
+
+	It("builds u32 filters for unshaped subnets", func() {
+		_, subnet, _ := net.ParseCIDR("10.96.0.0/12")
+		f := newSubnetFilter(3, netlink.MakeHandle(1, 0), subnet, false, netlink.MakeHandle(1, 2))
+		Expect(f.Protocol).To(Equal(uint16(syscall.ETH_P_IP)))
+		Expect(f.ClassId).To(Equal(netlink.MakeHandle(1, 2)))
+		Expect(f.Sel.Keys).To(Equal([]netlink.TcU32Key{
+			{Mask: 0xfff00000, Val: 0x0a600000, Off: 12},
+		}))
+
+		_, subnet, _ = net.ParseCIDR("fd00:1:2::/48")
+		f = newSubnetFilter(3, netlink.MakeHandle(1, 0), subnet, true, netlink.MakeHandle(1, 2))
+		Expect(f.Protocol).To(Equal(uint16(syscall.ETH_P_IPV6)))
+		Expect(f.Sel.Keys).To(Equal([]netlink.TcU32Key{
+			{Mask: 0xffffffff, Val: 0xfd000001, Off: 24},
+			{Mask: 0xffff0000, Val: 0x00020000, Off: 28},
+		}))
+	})
+})
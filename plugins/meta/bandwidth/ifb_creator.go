@@ -15,7 +15,9 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
 	"syscall"
 
@@ -24,9 +26,60 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-const latencyInMillis = 25
+const defaultLatencyInMillis = 25
+
+const (
+	shapingModeTBF = "tbf"
+	shapingModeHTB = "htb"
+)
+
+// The HTB class layout is:
+//
+// 1:   htb qdisc, unclassified traffic goes to 1:30
+// 1:1  parent class, uncapped
+// 1:2  unshaped class, uncapped. Traffic to/from unshapedSubnets
+// 1:30 shaped class, rate and ceil as configured
+const (
+	htbParentClassMinor   = 1
+	htbUnshapedClassMinor = 2
+	htbShapedClassMinor   = 0x30
+)
+
+// The largest rate the kernel HTB rate spec can express, in bits
+const uncappedRateInBits = uint64(math.MaxUint32) * 8
+
+// shapingOpts are the settings shared by ingress and egress shaping
+type shapingOpts struct {
+	mode            string
+	latencyInMillis int
+	unshapedSubnets []*net.IPNet
+
+	// inContainer is set when shaping the container interface inside its
+	// netns, rather than the host side veth. The direction of the traffic
+	// on the device is then reversed.
+	inContainer bool
+
+	// shaped is set when a previous ADD set up shaping for the container,
+	// which is then removed for the directions without limits. Otherwise
+	// the qdiscs of the device are not touched for them.
+	shaped bool
+}
 
 func CreateIfb(ifbDeviceName string, mtu int) error {
+	// Reuse the device if it was created by a previous ADD
+	if link, err := netlink.LinkByName(ifbDeviceName); err == nil {
+		if link.Type() != "ifb" {
+			return fmt.Errorf("%q already exists and is not an ifb device", ifbDeviceName)
+		}
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("setting MTU: %s", err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("setting link up: %s", err)
+		}
+		return nil
+	}
+
 	err := netlink.LinkAdd(&netlink.Ifb{
 		LinkAttrs: netlink.LinkAttrs{
 			Name:  ifbDeviceName,
@@ -50,72 +103,286 @@ func TeardownIfb(deviceName string) error {
 	return err
 }
 
-func CreateIngressQdisc(rateInBits, burstInBits int, hostDeviceName string) error {
-	hostDevice, err := netlink.LinkByName(hostDeviceName)
+// CreateIngressQdisc limits the traffic going to the container. Normally
+// that is the traffic sent by the host side veth. When shaping inside the
+// container, it is the traffic received by the container interface, which
+// is redirected to the ifb device.
+func CreateIngressQdisc(rateInBits, burstInBits, ceilInBits int, deviceName string, ifbDeviceName string, opts shapingOpts) error {
+	// Unshaped subnets are matched on the source address.
+	if opts.inContainer {
+		return shapeReceived(rateInBits, burstInBits, ceilInBits, deviceName, ifbDeviceName, opts, false)
+	}
+	return shapeSent(rateInBits, burstInBits, ceilInBits, deviceName, opts, false)
+}
+
+// CreateEgressQdisc limits the traffic coming from the container. Normally
+// that is the traffic received by the host side veth, which is redirected
+// to the ifb device. When shaping inside the container, it is the traffic
+// sent by the container interface.
+func CreateEgressQdisc(rateInBits, burstInBits, ceilInBits int, deviceName string, ifbDeviceName string, opts shapingOpts) error {
+	// Unshaped subnets are matched on the destination address.
+	if opts.inContainer {
+		return shapeSent(rateInBits, burstInBits, ceilInBits, deviceName, opts, true)
+	}
+	return shapeReceived(rateInBits, burstInBits, ceilInBits, deviceName, ifbDeviceName, opts, true)
+}
+
+// RemoveIngressQdisc removes the shaping set up by CreateIngressQdisc, if any.
+func RemoveIngressQdisc(deviceName string, ifbDeviceName string, opts shapingOpts) error {
+	if opts.inContainer {
+		return removeReceivedShaping(deviceName, ifbDeviceName)
+	}
+	return removeSentShaping(deviceName)
+}
+
+// RemoveEgressQdisc removes the shaping set up by CreateEgressQdisc, if any.
+func RemoveEgressQdisc(deviceName string, ifbDeviceName string, opts shapingOpts) error {
+	if opts.inContainer {
+		return removeSentShaping(deviceName)
+	}
+	return removeReceivedShaping(deviceName, ifbDeviceName)
+}
+
+// shapeSent shapes the traffic sent by the device with a root qdisc.
+func shapeSent(rateInBits, burstInBits, ceilInBits int, deviceName string, opts shapingOpts, matchDst bool) error {
+	device, err := netlink.LinkByName(deviceName)
 	if err != nil {
-		return fmt.Errorf("get host device: %s", err)
+		return fmt.Errorf("get device: %s", err)
 	}
-	return createTBF(rateInBits, burstInBits, hostDevice.Attrs().Index)
+	return createShaping(rateInBits, burstInBits, ceilInBits, device.Attrs().Index, opts, matchDst)
 }
 
-func CreateEgressQdisc(rateInBits, burstInBits int, hostDeviceName string, ifbDeviceName string) error {
+// shapeReceived redirects the traffic received by the device to the ifb
+// device, and shapes it there.
+func shapeReceived(rateInBits, burstInBits, ceilInBits int, deviceName string, ifbDeviceName string, opts shapingOpts, matchDst bool) error {
 	ifbDevice, err := netlink.LinkByName(ifbDeviceName)
 	if err != nil {
 		return fmt.Errorf("get ifb device: %s", err)
 	}
-	hostDevice, err := netlink.LinkByName(hostDeviceName)
+	device, err := netlink.LinkByName(deviceName)
 	if err != nil {
-		return fmt.Errorf("get host device: %s", err)
+		return fmt.Errorf("get device: %s", err)
 	}
 
-	// add qdisc ingress on host device
+	// add qdisc ingress on the device, unless a previous ADD already did;
+	// the ingress qdisc cannot be replaced in place
 	ingress := &netlink.Ingress{
 		QdiscAttrs: netlink.QdiscAttrs{
-			LinkIndex: hostDevice.Attrs().Index,
+			LinkIndex: device.Attrs().Index,
 			Handle:    netlink.MakeHandle(0xffff, 0), // ffff:
 			Parent:    netlink.HANDLE_INGRESS,
 		},
 	}
 
-	err = netlink.QdiscAdd(ingress)
+	exists, err := hasIngressQdisc(device)
 	if err != nil {
-		return fmt.Errorf("create ingress qdisc: %s", err)
+		return fmt.Errorf("list qdiscs: %s", err)
 	}
-
-	// add filter on host device to mirror traffic to ifb device
-	filter := &netlink.U32{
-		FilterAttrs: netlink.FilterAttrs{
-			LinkIndex: hostDevice.Attrs().Index,
-			Parent:    ingress.QdiscAttrs.Handle,
-			Priority:  1,
-			Protocol:  syscall.ETH_P_ALL,
-		},
-		ClassId:    netlink.MakeHandle(1, 1),
-		RedirIndex: ifbDevice.Attrs().Index,
-		Actions: []netlink.Action{
-			&netlink.MirredAction{
-				ActionAttrs:  netlink.ActionAttrs{},
-				MirredAction: netlink.TCA_EGRESS_REDIR,
-				Ifindex:      ifbDevice.Attrs().Index,
-			},
-		},
+	if !exists {
+		err = netlink.QdiscAdd(ingress)
+		if err != nil {
+			return fmt.Errorf("create ingress qdisc: %s", err)
+		}
 	}
-	err = netlink.FilterAdd(filter)
+
+	// add filter on the device to mirror traffic to ifb device, unless a
+	// previous ADD already did
+	redirects, err := listRedirects(device, ifbDevice.Attrs().Index)
 	if err != nil {
-		return fmt.Errorf("add filter: %s", err)
+		return fmt.Errorf("list filters: %s", err)
+	}
+	if len(redirects) == 0 {
+		filter := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: device.Attrs().Index,
+				Parent:    ingress.QdiscAttrs.Handle,
+				Priority:  1,
+				Protocol:  syscall.ETH_P_ALL,
+			},
+			ClassId:    netlink.MakeHandle(1, 1),
+			RedirIndex: ifbDevice.Attrs().Index,
+			Actions: []netlink.Action{
+				&netlink.MirredAction{
+					ActionAttrs:  netlink.ActionAttrs{},
+					MirredAction: netlink.TCA_EGRESS_REDIR,
+					Ifindex:      ifbDevice.Attrs().Index,
+				},
+			},
+		}
+		err = netlink.FilterAdd(filter)
+		if err != nil {
+			return fmt.Errorf("add filter: %s", err)
+		}
 	}
 
 	// throttle traffic on ifb device
-	err = createTBF(rateInBits, burstInBits, ifbDevice.Attrs().Index)
+	err = createShaping(rateInBits, burstInBits, ceilInBits, ifbDevice.Attrs().Index, opts, matchDst)
 	if err != nil {
 		return fmt.Errorf("create ifb qdisc: %s", err)
 	}
 	return nil
 }
 
-func createTBF(rateInBits, burstInBits, linkIndex int) error {
+// removeSentShaping deletes the root qdisc created by shapeSent.
+func removeSentShaping(deviceName string) error {
+	device, err := netlink.LinkByName(deviceName)
+	if err != nil {
+		return fmt.Errorf("get device: %s", err)
+	}
+
+	qdiscs, err := netlink.QdiscList(device)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	for _, q := range qdiscs {
+		if isShapingQdisc(q) {
+			if err := netlink.QdiscDel(q); err != nil {
+				return fmt.Errorf("delete qdisc: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeReceivedShaping deletes the redirect created by shapeReceived and
+// the ifb device. The ingress qdisc is only deleted if no other filters use it.
+func removeReceivedShaping(deviceName string, ifbDeviceName string) error {
+	device, err := netlink.LinkByName(deviceName)
+	if err != nil {
+		return fmt.Errorf("get device: %s", err)
+	}
+
+	ifbDevice, err := netlink.LinkByName(ifbDeviceName)
+	if err != nil {
+		// nothing was redirected
+		return nil
+	}
+
+	redirects, err := listRedirects(device, ifbDevice.Attrs().Index)
+	if err != nil {
+		return fmt.Errorf("list filters: %s", err)
+	}
+	for _, f := range redirects {
+		if err := netlink.FilterDel(f); err != nil {
+			return fmt.Errorf("delete filter: %s", err)
+		}
+	}
+
+	filters, err := netlink.FilterList(device, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return fmt.Errorf("list filters: %s", err)
+	}
+	if len(filters) == 0 {
+		qdiscs, err := netlink.QdiscList(device)
+		if err != nil {
+			return fmt.Errorf("list qdiscs: %s", err)
+		}
+		for _, q := range qdiscs {
+			if _, ok := q.(*netlink.Ingress); ok {
+				if err := netlink.QdiscDel(q); err != nil {
+					return fmt.Errorf("delete ingress qdisc: %s", err)
+				}
+			}
+		}
+	}
+
+	return TeardownIfb(ifbDeviceName)
+}
+
+// listRedirects returns the filters on the ingress qdisc of the device that
+// redirect to the given ifb device.
+func listRedirects(device netlink.Link, ifbIndex int) ([]netlink.Filter, error) {
+	filters, err := netlink.FilterList(device, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	redirects := []netlink.Filter{}
+	for _, f := range filters {
+		u32, ok := f.(*netlink.U32)
+		if !ok {
+			continue
+		}
+		for _, a := range u32.Actions {
+			if m, ok := a.(*netlink.MirredAction); ok && m.Ifindex == ifbIndex {
+				redirects = append(redirects, f)
+				break
+			}
+		}
+	}
+	return redirects, nil
+}
+
+// isShapingQdisc returns true if the qdisc is a root qdisc this plugin creates
+func isShapingQdisc(q netlink.Qdisc) bool {
+	if q.Attrs().Parent != netlink.HANDLE_ROOT || q.Attrs().Handle != netlink.MakeHandle(1, 0) {
+		return false
+	}
+	switch q.(type) {
+	case *netlink.Tbf, *netlink.Htb:
+		return true
+	}
+	return false
+}
+
+// hasIngressQdisc returns true if the link has an ingress qdisc
+func hasIngressQdisc(link netlink.Link) (bool, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return false, err
+	}
+	for _, q := range qdiscs {
+		if _, ok := q.(*netlink.Ingress); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// replaceRootQdisc installs qdisc as the root qdisc of its link. The kernel
+// cannot change the kind of a qdisc, so a root qdisc of another kind is
+// deleted first.
+func replaceRootQdisc(qdisc netlink.Qdisc) error {
+	link, err := netlink.LinkByIndex(qdisc.Attrs().LinkIndex)
+	if err != nil {
+		return err
+	}
+
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		// Handle 0 is the default qdisc, which is simply replaced
+		if q.Attrs().Parent != netlink.HANDLE_ROOT || q.Attrs().Handle == 0 {
+			continue
+		}
+		if q.Type() != qdisc.Type() || q.Attrs().Handle != qdisc.Attrs().Handle {
+			if err := netlink.QdiscDel(q); err != nil {
+				return err
+			}
+			continue
+		}
+		// htb does not support changes, but its settings are fixed; the
+		// classes are replaced instead.
+		if _, ok := q.(*netlink.Htb); ok {
+			return nil
+		}
+	}
+
+	return netlink.QdiscReplace(qdisc)
+}
+
+func createShaping(rateInBits, burstInBits, ceilInBits, linkIndex int, opts shapingOpts, matchDst bool) error {
+	if opts.mode == shapingModeHTB {
+		return createHTB(rateInBits, burstInBits, ceilInBits, linkIndex, opts.unshapedSubnets, matchDst)
+	}
+	return createTBF(rateInBits, burstInBits, linkIndex, opts.latencyInMillis)
+}
+
+func createTBF(rateInBits, burstInBits, linkIndex, latencyInMillis int) error {
 	// Equivalent to
-	// tc qdisc add dev link root tbf
+	// tc qdisc replace dev link root tbf
 	//		rate netConf.BandwidthLimits.Rate
 	//		burst netConf.BandwidthLimits.Burst
 	if rateInBits <= 0 {
@@ -127,7 +394,7 @@ func createTBF(rateInBits, burstInBits, linkIndex int) error {
 	rateInBytes := rateInBits / 8
 	burstInBytes := burstInBits / 8
 	bufferInBytes := buffer(uint64(rateInBytes), uint32(burstInBytes))
-	latency := latencyInUsec(latencyInMillis)
+	latency := latencyInUsec(float64(latencyInMillis))
 	limitInBytes := limit(uint64(rateInBytes), latency, uint32(burstInBytes))
 
 	qdisc := &netlink.Tbf{
@@ -140,13 +407,164 @@ func createTBF(rateInBits, burstInBits, linkIndex int) error {
 		Rate:   uint64(rateInBytes),
 		Buffer: uint32(bufferInBytes),
 	}
-	err := netlink.QdiscAdd(qdisc)
+	err := replaceRootQdisc(qdisc)
 	if err != nil {
 		return fmt.Errorf("create qdisc: %s", err)
 	}
 	return nil
 }
 
+func createHTB(rateInBits, burstInBits, ceilInBits, linkIndex int, unshapedSubnets []*net.IPNet, matchDst bool) error {
+	// Equivalent to
+	// tc qdisc replace dev link root handle 1: htb default 30
+	// tc class replace dev link parent 1: classid 1:1 htb rate <uncapped>
+	// tc class replace dev link parent 1:1 classid 1:2 htb rate <uncapped>
+	// tc class replace dev link parent 1:1 classid 1:30 htb
+	//		rate rate ceil ceil burst burst cburst burst
+	// tc filter del dev link parent 1:
+	// tc filter add dev link parent 1: u32
+	//		match ip src|dst unshapedSubnet flowid 1:2
+	if rateInBits <= 0 {
+		return fmt.Errorf("invalid rate: %d", rateInBits)
+	}
+	if burstInBits <= 0 {
+		return fmt.Errorf("invalid burst: %d", burstInBits)
+	}
+	if ceilInBits == 0 {
+		ceilInBits = rateInBits
+	}
+
+	qdiscHandle := netlink.MakeHandle(1, 0)
+	qdisc := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: linkIndex,
+		Handle:    qdiscHandle,
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	qdisc.Defcls = htbShapedClassMinor
+	if err := replaceRootQdisc(qdisc); err != nil {
+		return fmt.Errorf("create qdisc: %s", err)
+	}
+
+	parentClass := newHTBClass(linkIndex, qdiscHandle, htbParentClassMinor, uncappedRateInBits, uncappedRateInBits, 0)
+	if err := netlink.ClassReplace(parentClass); err != nil {
+		return fmt.Errorf("create parent class: %s", err)
+	}
+
+	unshapedClass := newHTBClass(linkIndex, parentClass.Handle, htbUnshapedClassMinor, uncappedRateInBits, uncappedRateInBits, 0)
+	if err := netlink.ClassReplace(unshapedClass); err != nil {
+		return fmt.Errorf("create unshaped class: %s", err)
+	}
+
+	shapedClass := newHTBClass(linkIndex, parentClass.Handle, htbShapedClassMinor, uint64(rateInBits), uint64(ceilInBits), uint32(burstInBits/8))
+	if err := netlink.ClassReplace(shapedClass); err != nil {
+		return fmt.Errorf("create shaped class: %s", err)
+	}
+
+	// Filters cannot be replaced, so drop the ones from a previous ADD
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return err
+	}
+	filters, err := netlink.FilterList(link, qdiscHandle)
+	if err != nil {
+		return fmt.Errorf("list filters: %s", err)
+	}
+	for _, f := range filters {
+		if err := netlink.FilterDel(f); err != nil {
+			return fmt.Errorf("delete filter: %s", err)
+		}
+	}
+
+	for _, subnet := range unshapedSubnets {
+		filter := newSubnetFilter(linkIndex, qdiscHandle, subnet, matchDst, unshapedClass.Handle)
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("add filter for unshaped subnet %s: %s", subnet, err)
+		}
+	}
+	return nil
+}
+
+func newHTBClass(linkIndex int, parent uint32, minor uint16, rateInBits, ceilInBits uint64, burstInBytes uint32) *netlink.HtbClass {
+	class := netlink.NewHtbClass(
+		netlink.ClassAttrs{
+			LinkIndex: linkIndex,
+			Parent:    parent,
+			Handle:    netlink.MakeHandle(1, minor),
+		},
+		netlink.HtbClassAttrs{
+			Rate:    rateInBits,
+			Ceil:    ceilInBits,
+			Buffer:  burstInBytes,
+			Cbuffer: burstInBytes,
+		},
+	)
+	// Let the kernel derive the quantum from the rate
+	class.Quantum = 0
+	return class
+}
+
+// newSubnetFilter returns a u32 filter that sends traffic from (or to,
+// if matchDst is set) subnet to the given class.
+func newSubnetFilter(linkIndex int, parent uint32, subnet *net.IPNet, matchDst bool, classID uint32) *netlink.U32 {
+	var protocol uint16
+	var addr []byte
+	var off int32
+	var prio uint16
+
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		// offsets of the addresses in the ipv4 header
+		protocol, addr, off, prio = syscall.ETH_P_IP, ip4, 12, 1
+		if matchDst {
+			off = 16
+		}
+	} else {
+		// offsets of the addresses in the ipv6 header
+		protocol, addr, off, prio = syscall.ETH_P_IPV6, subnet.IP.To16(), 8, 2
+		if matchDst {
+			off = 24
+		}
+	}
+
+	// u32 matches on 32 bit words, so split the prefix in to one key per
+	// word it covers.
+	mask := net.CIDRMask(prefixLen(subnet), len(addr)*8)
+	keys := []netlink.TcU32Key{}
+	for i := 0; i < len(addr); i += 4 {
+		m := binary.BigEndian.Uint32(mask[i : i+4])
+		if m == 0 {
+			break
+		}
+		keys = append(keys, netlink.TcU32Key{
+			Mask: m,
+			Val:  binary.BigEndian.Uint32(addr[i:i+4]) & m,
+			Off:  off + int32(i),
+		})
+	}
+	if len(keys) == 0 {
+		// a /0 matches everything
+		keys = append(keys, netlink.TcU32Key{})
+	}
+
+	return &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: linkIndex,
+			Parent:    parent,
+			Priority:  prio,
+			Protocol:  protocol,
+		},
+		ClassId: classID,
+		Sel: &netlink.TcU32Sel{
+			Flags: netlink.TC_U32_TERMINAL,
+			Keys:  keys,
+		},
+	}
+}
+
+func prefixLen(subnet *net.IPNet) int {
+	ones, _ := subnet.Mask.Size()
+	return ones
+}
+
 func tick2Time(tick uint32) uint32 {
 	return uint32(float64(tick) / float64(netlink.TickInUsec()))
 }
@@ -19,16 +19,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"os"
+	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
 
 	"github.com/vishvananda/netlink"
 )
 
+const (
+	ifbDevicePrefix    = "bwp"
+	maxIfbDeviceLength = 15 // IFNAMSIZ - 1
+)
+
 // BandwidthEntry corresponds to a single entry in the bandwidth argument,
 // see CONVENTIONS.md
 type BandwidthEntry struct {
@@ -37,6 +46,9 @@ type BandwidthEntry struct {
 
 	EgressRate  int `json:"egressRate"`  //Bandwidth rate in Kbps for traffic through container. 0 for no limit. If egressRate is set, egressBurst must also be set
 	EgressBurst int `json:"egressBurst"` //Bandwidth burst in Kb for traffic through container. 0 for no limit. If egressBurst is set, egressRate must also be set
+
+	IngressCeil int `json:"ingressCeil,omitempty"` //Bandwidth ceil in Kbps the container can borrow up to, htb only. Defaults to ingressRate
+	EgressCeil  int `json:"egressCeil,omitempty"`  //Bandwidth ceil in Kbps the container can borrow up to, htb only. Defaults to egressRate
 }
 
 func (bw *BandwidthEntry) isZero() bool {
@@ -46,6 +58,10 @@ func (bw *BandwidthEntry) isZero() bool {
 type PluginConf struct {
 	types.NetConf
 
+	ShapingMode     string   `json:"shapingMode,omitempty"`     //"tbf" (default) or "htb"
+	LatencyMs       int      `json:"latencyMs,omitempty"`       //Maximum time in ms a packet can wait in the tbf queue. Defaults to 25
+	UnshapedSubnets []string `json:"unshapedSubnets,omitempty"` //Traffic to or from these CIDRs is not shaped, htb only
+
 	RuntimeConfig struct {
 		Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
@@ -55,6 +71,17 @@ type PluginConf struct {
 	RawPrevResult *map[string]interface{} `json:"prevResult"`
 	PrevResult    *current.Result         `json:"-"`
 	*BandwidthEntry
+
+	unshapedSubnets []*net.IPNet
+}
+
+// shapingOpts returns the settings used to build the qdiscs
+func (conf *PluginConf) shapingOpts() shapingOpts {
+	return shapingOpts{
+		mode:            conf.ShapingMode,
+		latencyInMillis: conf.LatencyMs,
+		unshapedSubnets: conf.unshapedSubnets,
+	}
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -80,6 +107,33 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 			return nil, fmt.Errorf("could not convert result to current version: %v", err)
 		}
 	}
+
+	switch conf.ShapingMode {
+	case "":
+		conf.ShapingMode = shapingModeTBF
+	case shapingModeTBF, shapingModeHTB:
+	default:
+		return nil, fmt.Errorf("invalid shapingMode %q, must be %q or %q", conf.ShapingMode, shapingModeTBF, shapingModeHTB)
+	}
+
+	switch {
+	case conf.LatencyMs < 0:
+		return nil, fmt.Errorf("latencyMs must be a positive integer")
+	case conf.LatencyMs == 0:
+		conf.LatencyMs = defaultLatencyInMillis
+	}
+
+	if len(conf.UnshapedSubnets) > 0 && conf.ShapingMode != shapingModeHTB {
+		return nil, fmt.Errorf("unshapedSubnets requires shapingMode %q", shapingModeHTB)
+	}
+	for _, s := range conf.UnshapedSubnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unshaped subnet %q: %v", s, err)
+		}
+		conf.unshapedSubnets = append(conf.unshapedSubnets, subnet)
+	}
+
 	bandwidth := getBandwidth(&conf)
 	if bandwidth != nil {
 		err := validateRateAndBurst(bandwidth.IngressRate, bandwidth.IngressBurst)
@@ -90,6 +144,14 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 		if err != nil {
 			return nil, err
 		}
+		err = validateCeil(conf.ShapingMode, bandwidth.IngressRate, bandwidth.IngressCeil)
+		if err != nil {
+			return nil, err
+		}
+		err = validateCeil(conf.ShapingMode, bandwidth.EgressRate, bandwidth.EgressCeil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &conf, nil
@@ -116,14 +178,68 @@ func validateRateAndBurst(rate int, burst int) error {
 	return nil
 }
 
+func validateCeil(mode string, rate int, ceil int) error {
+	switch {
+	case ceil == 0:
+		return nil
+	case mode != shapingModeHTB:
+		return fmt.Errorf("ceil requires shapingMode %q", shapingModeHTB)
+	case ceil < rate:
+		return fmt.Errorf("ceil must not be lower than rate")
+	}
+
+	return nil
+}
+
+// getIfbDeviceName returns the name of the ifb device for the container. It
+// is ifbDevicePrefix followed by as much of the hash of the network name and
+// container ID as fits in an interface name, to make collisions unlikely.
 func getIfbDeviceName(networkName string, containerId string) (string, error) {
+	hash, err := ifbDeviceHash(networkName, containerId)
+	if err != nil {
+		return "", err
+	}
+
+	return (ifbDevicePrefix + hash)[:maxIfbDeviceLength], nil
+}
+
+// getLegacyIfbDeviceName returns the name older versions gave the ifb
+// device, the first 4 characters of the hash, so that DEL still removes
+// devices created before an upgrade.
+func getLegacyIfbDeviceName(networkName string, containerId string) (string, error) {
+	hash, err := ifbDeviceHash(networkName, containerId)
+	if err != nil {
+		return "", err
+	}
+
+	return hash[:4], nil
+}
+
+func ifbDeviceHash(networkName string, containerId string) (string, error) {
 	hash := sha1.New()
 	_, err := hash.Write([]byte(networkName + containerId))
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%x", hash.Sum(nil))[:4], nil
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// getIfbInterfaces returns the ifb devices that ADD recorded in the result,
+// including one with the legacy name legacyName recorded by older versions.
+func getIfbInterfaces(result *current.Result, legacyName string) []*current.Interface {
+	if result == nil {
+		return nil
+	}
+
+	var ifbInterfaces []*current.Interface
+	for _, iface := range result.Interfaces {
+		if len(iface.Name) == maxIfbDeviceLength && strings.HasPrefix(iface.Name, ifbDevicePrefix) ||
+			iface.Name == legacyName && iface.Sandbox == "" {
+			ifbInterfaces = append(ifbInterfaces, iface)
+		}
+	}
+	return ifbInterfaces
 }
 
 func getMTU(deviceName string) (int, error) {
@@ -159,7 +275,21 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	bandwidth := getBandwidth(conf)
-	if bandwidth == nil || bandwidth.isZero() {
+	if bandwidth == nil {
+		bandwidth = &BandwidthEntry{}
+	}
+
+	ifbDeviceName, err := getIfbDeviceName(conf.Name, args.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	// Shaping set up by a previous ADD is removed for the directions
+	// without limits. Only the ifb device of the container shows that there
+	// was any, so without it there is nothing to do.
+	opts := conf.shapingOpts()
+	opts.shaped = ifbExists(ifbDeviceName, args.Netns)
+	if bandwidth.isZero() && !opts.shaped {
 		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
 	}
 
@@ -168,49 +298,138 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	hostInterface, err := getHostInterface(conf.PrevResult.Interfaces)
+	if err == nil {
+		ifbInterface, err := setupShaping(bandwidth, hostInterface.Name, ifbDeviceName, opts)
+		if err != nil {
+			return err
+		}
+		addIfbInterface(conf.PrevResult, ifbInterface)
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	// There is no host side veth, e.g. after macvlan, ipvlan or host-device.
+	// Shape the container interface inside its netns instead.
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		if bandwidth.isZero() {
+			return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+		}
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	opts.inContainer = true
+	var ifbInterface *current.Interface
+	err = netns.Do(func(_ ns.NetNS) error {
+		var err error
+		ifbInterface, err = setupShaping(bandwidth, args.IfName, ifbDeviceName, opts)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	if ifbInterface != nil {
+		ifbInterface.Sandbox = args.Netns
+	}
+	addIfbInterface(conf.PrevResult, ifbInterface)
 
-	if bandwidth.IngressRate > 0 && bandwidth.IngressBurst > 0 {
-		err = CreateIngressQdisc(bandwidth.IngressRate, bandwidth.IngressBurst, hostInterface.Name)
-		if err != nil {
-			return err
-		}
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+// ifbExists returns true if the ifb device of the container exists, on the
+// host or inside its netns
+func ifbExists(ifbDeviceName string, netnsPath string) bool {
+	if _, err := netlink.LinkByName(ifbDeviceName); err == nil {
+		return true
+	}
+	if netnsPath == "" {
+		return false
+	}
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return false
 	}
+	defer netns.Close()
 
-	if bandwidth.EgressRate > 0 && bandwidth.EgressBurst > 0 {
-		mtu, err := getMTU(hostInterface.Name)
-		if err != nil {
-			return err
+	err = netns.Do(func(_ ns.NetNS) error {
+		_, err := netlink.LinkByName(ifbDeviceName)
+		return err
+	})
+	return err == nil
+}
+
+// addIfbInterface records the ifb device in the result, replacing the entry
+// of a previous ADD if there is one.
+func addIfbInterface(result *current.Result, ifbInterface *current.Interface) {
+	if ifbInterface == nil {
+		return
+	}
+	for i, iface := range result.Interfaces {
+		if iface.Name == ifbInterface.Name {
+			result.Interfaces[i] = ifbInterface
+			return
 		}
+	}
+	result.Interfaces = append(result.Interfaces, ifbInterface)
+}
+
+// setupShaping creates or updates the qdiscs limiting the traffic of
+// deviceName, and returns the ifb device if one is needed. Shaping for a
+// direction without limits is removed, so that running ADD again converges
+// to the new settings.
+func setupShaping(bandwidth *BandwidthEntry, deviceName string, ifbDeviceName string, opts shapingOpts) (*current.Interface, error) {
+	ingress := bandwidth.IngressRate > 0 && bandwidth.IngressBurst > 0
+	egress := bandwidth.EgressRate > 0 && bandwidth.EgressBurst > 0
+
+	// The traffic received by the device has to go through an ifb device
+	needIfb := egress
+	if opts.inContainer {
+		needIfb = ingress
+	}
 
-		ifbDeviceName, err := getIfbDeviceName(conf.Name, args.ContainerID)
+	var ifbInterface *current.Interface
+	if needIfb {
+		mtu, err := getMTU(deviceName)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		err = CreateIfb(ifbDeviceName, mtu)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		ifbDevice, err := netlink.LinkByName(ifbDeviceName)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		conf.PrevResult.Interfaces = append(conf.PrevResult.Interfaces, &current.Interface{
+		ifbInterface = &current.Interface{
 			Name: ifbDeviceName,
 			Mac:  ifbDevice.Attrs().HardwareAddr.String(),
-		})
-		err = CreateEgressQdisc(bandwidth.EgressRate, bandwidth.EgressBurst, hostInterface.Name, ifbDeviceName)
-		if err != nil {
-			return err
 		}
 	}
 
-	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	var err error
+	if ingress {
+		err = CreateIngressQdisc(bandwidth.IngressRate, bandwidth.IngressBurst, bandwidth.IngressCeil, deviceName, ifbDeviceName, opts)
+	} else if opts.shaped {
+		err = RemoveIngressQdisc(deviceName, ifbDeviceName, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if egress {
+		err = CreateEgressQdisc(bandwidth.EgressRate, bandwidth.EgressBurst, bandwidth.EgressCeil, deviceName, ifbDeviceName, opts)
+	} else if opts.shaped {
+		err = RemoveEgressQdisc(deviceName, ifbDeviceName, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ifbInterface, nil
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -219,6 +438,27 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	legacyIfbDeviceName, err := getLegacyIfbDeviceName(conf.Name, args.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	// Tear down the devices ADD created, in case the netconf has changed
+	// since then.
+	if ifbInterfaces := getIfbInterfaces(conf.PrevResult, legacyIfbDeviceName); len(ifbInterfaces) > 0 {
+		for _, ifbInterface := range ifbInterfaces {
+			if ifbInterface.Sandbox == "" {
+				err = TeardownIfb(ifbInterface.Name)
+			} else {
+				err = teardownContainerIfb(args.Netns, ifbInterface.Name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	ifbDeviceName, err := getIfbDeviceName(conf.Name, args.ContainerID)
 	if err != nil {
 		return err
@@ -228,10 +468,40 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	return nil
+	// Older versions only created the device on the host
+	if err := TeardownIfb(legacyIfbDeviceName); err != nil {
+		return err
+	}
+
+	return teardownContainerIfb(args.Netns, ifbDeviceName)
+}
+
+// teardownContainerIfb deletes an ifb device created inside the container.
+// If the netns is already gone, so is the device.
+func teardownContainerIfb(netnsPath string, ifbDeviceName string) error {
+	if netnsPath == "" {
+		return nil
+	}
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		return TeardownIfb(ifbDeviceName)
+	})
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		if err := runStats(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// TODO: implement plugin version
 	skel.PluginMain(cmdAdd, cmdGet, cmdDel, version.PluginSupports("0.3.0", "0.3.1", version.Current()), "TODO")
 }
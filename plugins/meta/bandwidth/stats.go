@@ -0,0 +1,239 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Nested attributes of TCA_STATS2, see include/uapi/linux/gen_stats.h
+const (
+	tcaStatsBasic = 1
+	tcaStatsQueue = 3
+)
+
+// QdiscStats are the counters of the root qdisc shaping one direction
+type QdiscStats struct {
+	Device     string `json:"device"`
+	Kind       string `json:"kind"`
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint32 `json:"packets"`
+	Drops      uint32 `json:"drops"`
+	Overlimits uint32 `json:"overlimits"`
+}
+
+// Stats is printed by the stats subcommand. A direction that is not shaped
+// is omitted.
+type Stats struct {
+	Ingress *QdiscStats `json:"ingress,omitempty"`
+	Egress  *QdiscStats `json:"egress,omitempty"`
+}
+
+// runStats implements `bandwidth stats -netns <path> [-ifname <name>] <network> <containerID>`
+func runStats(args []string, out io.Writer) error {
+	var netnsPath, ifName string
+	statsFlags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	statsFlags.StringVar(&netnsPath, "netns", "", "path to the network namespace of the container")
+	statsFlags.StringVar(&ifName, "ifname", "eth0", "name of the container interface")
+	if err := statsFlags.Parse(args); err != nil {
+		return err
+	}
+	if statsFlags.NArg() != 2 {
+		return fmt.Errorf("usage: bandwidth stats -netns <path> [-ifname <name>] <network> <containerID>")
+	}
+	if netnsPath == "" {
+		return fmt.Errorf("-netns is required")
+	}
+
+	stats, err := getStats(statsFlags.Arg(0), statsFlags.Arg(1), netnsPath, ifName)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(stats)
+}
+
+func getStats(networkName, containerID, netnsPath, ifName string) (*Stats, error) {
+	ifbDeviceName, err := getIfbDeviceName(networkName, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close()
+
+	var inContainer bool
+	err = netns.Do(func(ns.NetNS) error {
+		if _, err := netlink.LinkByName(ifbDeviceName); err == nil {
+			inContainer = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var hostInterface *current.Interface
+	if !inContainer {
+		hostInterface, err = findHostVeth(netns, ifName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Without a host side veth, e.g. after macvlan, ipvlan or host-device,
+	// the container interface is shaped inside its netns. Then the ingress
+	// traffic goes through the ifb device and the egress traffic is shaped
+	// on the container interface.
+	if hostInterface == nil {
+		var stats *Stats
+		err = netns.Do(func(ns.NetNS) error {
+			var err error
+			stats, err = getShapingStats(ifName, ifbDeviceName, true)
+			return err
+		})
+		return stats, err
+	}
+	return getShapingStats(hostInterface.Name, ifbDeviceName, false)
+}
+
+// getShapingStats returns the counters of the root qdiscs of deviceName and
+// of the ifb device, if it exists, in the current netns
+func getShapingStats(deviceName, ifbDeviceName string, inContainer bool) (*Stats, error) {
+	deviceStats, err := getRootQdiscStats(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	var ifbStats *QdiscStats
+	if _, err := netlink.LinkByName(ifbDeviceName); err == nil {
+		ifbStats, err = getRootQdiscStats(ifbDeviceName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if inContainer {
+		return &Stats{Ingress: ifbStats, Egress: deviceStats}, nil
+	}
+	return &Stats{Ingress: deviceStats, Egress: ifbStats}, nil
+}
+
+// findHostVeth returns the host side of the container's veth, or nil if the
+// container interface is not a veth with its peer in the host netns
+func findHostVeth(netns ns.NetNS, ifName string) (*current.Interface, error) {
+	var peerIndex int
+	err := netns.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find %q: %v", ifName, err)
+		}
+		if link.Type() != "veth" {
+			return nil
+		}
+		_, peerIndex, err = ip.GetVethPeerIfindex(ifName)
+		return err
+	})
+	if err != nil || peerIndex == 0 {
+		return nil, err
+	}
+
+	peer, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil, nil
+	}
+	return getHostInterface([]*current.Interface{{Name: peer.Attrs().Name}})
+}
+
+// getRootQdiscStats returns the counters of the shaping qdisc of the device,
+// or nil if it is not shaped. The vendored netlink does not parse qdisc
+// statistics, so the qdiscs are dumped here.
+func getRootQdiscStats(deviceName string) (*QdiscStats, error) {
+	link, err := netlink.LinkByName(deviceName)
+	if err != nil {
+		return nil, fmt.Errorf("get device: %s", err)
+	}
+	index := int32(link.Attrs().Index)
+
+	req := nl.NewNetlinkRequest(syscall.RTM_GETQDISC, syscall.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: index,
+	})
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWQDISC)
+	if err != nil {
+		return nil, fmt.Errorf("list qdiscs: %s", err)
+	}
+
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		if msg.Ifindex != index || msg.Parent != netlink.HANDLE_ROOT || msg.Handle != netlink.MakeHandle(1, 0) {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		return parseQdiscStats(deviceName, attrs)
+	}
+	return nil, nil
+}
+
+func parseQdiscStats(deviceName string, attrs []syscall.NetlinkRouteAttr) (*QdiscStats, error) {
+	stats := &QdiscStats{Device: deviceName}
+	native := nl.NativeEndian()
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.TCA_KIND:
+			stats.Kind = string(attr.Value[:len(attr.Value)-1])
+		case nl.TCA_STATS2:
+			nested, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range nested {
+				switch a.Attr.Type {
+				case tcaStatsBasic:
+					// struct gnet_stats_basic { __u64 bytes; __u32 packets; }
+					if len(a.Value) < 12 {
+						return nil, fmt.Errorf("short basic stats")
+					}
+					stats.Bytes = native.Uint64(a.Value[0:8])
+					stats.Packets = native.Uint32(a.Value[8:12])
+				case tcaStatsQueue:
+					// struct gnet_stats_queue { __u32 qlen, backlog, drops, requeues, overlimits; }
+					if len(a.Value) < 20 {
+						return nil, fmt.Errorf("short queue stats")
+					}
+					stats.Drops = native.Uint32(a.Value[8:12])
+					stats.Overlimits = native.Uint32(a.Value[16:20])
+				}
+			}
+		}
+	}
+	return stats, nil
+}
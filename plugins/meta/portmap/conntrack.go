@@ -0,0 +1,164 @@
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// UDP is connectionless, so conntrack keeps a flow alive for as long as
+// packets keep arriving. When a hostPort moves to a new container, the old
+// flows keep being translated to the previous container's IP until they
+// time out. We delete them whenever a mapping is installed or removed.
+
+// staleConnFilter matches conntrack flows that were created for one of
+// the mapped UDP host ports.
+//
+// A flow matches if its original destination port and address correspond
+// to a mapping, and its reply source - i.e. the post-DNAT destination - is
+// not keepIP. The address must be the host IP of the mapping or, if it has
+// none, one of hostIPs, so that flows merely routed through the host to the
+// same port elsewhere are left alone. If deleteIP is set, only flows whose
+// reply source is deleteIP match.
+type staleConnFilter struct {
+	entries  []PortMapEntry
+	hostIPs  []net.IP
+	keepIP   net.IP
+	deleteIP net.IP
+}
+
+// MatchConntrackFlow implements netlink.CustomConntrackFilter
+func (f *staleConnFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if flow.Forward.Protocol != syscall.IPPROTO_UDP {
+		return false
+	}
+
+	if f.keepIP != nil && f.keepIP.Equal(flow.Reverse.SrcIP) {
+		return false
+	}
+	if f.deleteIP != nil && !f.deleteIP.Equal(flow.Reverse.SrcIP) {
+		return false
+	}
+
+	for _, e := range f.entries {
+		if !strings.EqualFold(e.Protocol, "udp") {
+			continue
+		}
+		if int(flow.Forward.DstPort) != e.HostPort {
+			continue
+		}
+		if e.HostIP != "" {
+			if !net.ParseIP(e.HostIP).Equal(flow.Forward.DstIP) {
+				continue
+			}
+		} else if !containsIP(f.hostIPs, flow.Forward.DstIP) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ netlink.CustomConntrackFilter = (*staleConnFilter)(nil)
+
+// hasUDPMappings returns true if any of the entries is a UDP mapping
+func hasUDPMappings(entries []PortMapEntry) bool {
+	for _, e := range entries {
+		if strings.EqualFold(e.Protocol, "udp") {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteStaleConnections removes the conntrack entries for the mapped UDP
+// ports that do not point to containerIP, since they would otherwise keep
+// being forwarded to wherever the port pointed previously.
+func deleteStaleConnections(entries []PortMapEntry, containerIP net.IP) error {
+	if !hasUDPMappings(entries) {
+		return nil
+	}
+
+	hostIPs, err := getHostIPs(containerIP)
+	if err != nil {
+		return err
+	}
+	filter := &staleConnFilter{
+		entries: entries,
+		hostIPs: hostIPs,
+		keepIP:  containerIP,
+	}
+	_, err = netlink.ConntrackDeleteFilter(netlink.ConntrackTable, conntrackFamily(containerIP), filter)
+	return err
+}
+
+// deleteContainerConnections removes the conntrack entries for the mapped
+// UDP ports that were forwarded to containerIP.
+func deleteContainerConnections(entries []PortMapEntry, containerIP net.IP) error {
+	if !hasUDPMappings(entries) {
+		return nil
+	}
+
+	hostIPs, err := getHostIPs(containerIP)
+	if err != nil {
+		return err
+	}
+	filter := &staleConnFilter{
+		entries:  entries,
+		hostIPs:  hostIPs,
+		deleteIP: containerIP,
+	}
+	_, err = netlink.ConntrackDeleteFilter(netlink.ConntrackTable, conntrackFamily(containerIP), filter)
+	return err
+}
+
+// getHostIPs returns the local addresses of the host in the family of ip,
+// which mappings without a host IP forward from
+func getHostIPs(ip net.IP) ([]net.IP, error) {
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(nil, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the host addresses: %v", err)
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func conntrackFamily(ip net.IP) netlink.InetFamily {
+	if ip.To4() == nil {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
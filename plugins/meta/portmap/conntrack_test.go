@@ -0,0 +1,91 @@
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func makeFlow(proto uint8, origDst string, dport uint16, replySrc string) *netlink.ConntrackFlow {
+	flow := &netlink.ConntrackFlow{}
+	flow.Forward.Protocol = proto
+	flow.Forward.SrcIP = net.ParseIP("192.0.2.99")
+	flow.Forward.DstIP = net.ParseIP(origDst)
+	flow.Forward.SrcPort = 45678
+	flow.Forward.DstPort = dport
+	flow.Reverse.Protocol = proto
+	flow.Reverse.SrcIP = net.ParseIP(replySrc)
+	flow.Reverse.DstIP = net.ParseIP("192.0.2.99")
+	flow.Reverse.DstPort = 45678
+	return flow
+}
+
+var _ = Describe("conntrack cleanup", func() {
+	entries := []PortMapEntry{
+		{HostPort: 53, ContainerPort: 53, Protocol: "udp"},
+		{HostPort: 514, ContainerPort: 514, Protocol: "UDP", HostIP: "192.0.2.1"},
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+	}
+
+	hostIPs := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("192.0.2.1")}
+
+	It("matches flows to a mapped UDP port that point elsewhere", func() {
+		f := &staleConnFilter{entries: entries, hostIPs: hostIPs, keepIP: net.ParseIP("10.0.0.2")}
+
+		// forwarded to the previous container
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.1", 53, "10.0.0.7"))).To(BeTrue())
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "127.0.0.1", 53, "10.0.0.7"))).To(BeTrue())
+		// already going to the new container
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.1", 53, "10.0.0.2"))).To(BeFalse())
+		// unmapped port
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.1", 54, "10.0.0.7"))).To(BeFalse())
+		// tcp is left alone
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_TCP, "192.0.2.1", 8080, "10.0.0.7"))).To(BeFalse())
+	})
+
+	It("leaves flows to the same port on other hosts alone", func() {
+		f := &staleConnFilter{entries: entries, hostIPs: hostIPs, keepIP: net.ParseIP("10.0.0.2")}
+
+		// a query to an upstream DNS server, from a pod or the host
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "198.51.100.53", 53, "198.51.100.53"))).To(BeFalse())
+		// to an address that is not the host's
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.2", 53, "10.0.0.7"))).To(BeFalse())
+	})
+
+	It("respects the host IP of a mapping", func() {
+		f := &staleConnFilter{entries: entries, hostIPs: hostIPs, keepIP: net.ParseIP("10.0.0.2")}
+
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.1", 514, "10.0.0.7"))).To(BeTrue())
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.2", 514, "10.0.0.7"))).To(BeFalse())
+	})
+
+	It("matches only the container's flows on delete", func() {
+		f := &staleConnFilter{entries: entries, hostIPs: hostIPs, deleteIP: net.ParseIP("10.0.0.2")}
+
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.1", 53, "10.0.0.2"))).To(BeTrue())
+		Expect(f.MatchConntrackFlow(makeFlow(syscall.IPPROTO_UDP, "192.0.2.1", 53, "10.0.0.7"))).To(BeFalse())
+	})
+
+	It("skips the netlink call without UDP mappings", func() {
+		Expect(hasUDPMappings(entries)).To(BeTrue())
+		Expect(hasUDPMappings(entries[2:])).To(BeFalse())
+	})
+})
@@ -0,0 +1,178 @@
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/go-systemd/activation"
+)
+
+const socketPath = "/run/cni/portmap.sock"
+
+// ProxyArgs are the arguments of the Proxy.Add and Proxy.Del calls
+type ProxyArgs struct {
+	Name        string
+	ContainerID string
+	ContainerIP net.IP
+	PortMaps    []PortMapEntry
+}
+
+// Proxy maintains the userspace proxies for localhost port forwarding
+type Proxy struct {
+	mux      sync.Mutex
+	proxies  map[string][]proxy
+	listenIP net.IP
+}
+
+func newLocalhostProxy() *Proxy {
+	return &Proxy{
+		proxies:  make(map[string][]proxy),
+		listenIP: net.IPv6loopback,
+	}
+}
+
+func proxyKey(netName, containerID string) string {
+	return containerID + "/" + netName
+}
+
+// Add starts a proxy on localhost for every port mapping of the container.
+// Any proxies previously started for the container are replaced.
+func (p *Proxy) Add(args *ProxyArgs, reply *struct{}) error {
+	key := proxyKey(args.Name, args.ContainerID)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	closeProxies(p.proxies[key])
+	delete(p.proxies, key)
+
+	proxies := []proxy{}
+	for _, e := range args.PortMaps {
+		// Only mappings that would be reachable on localhost
+		if e.HostIP != "" && !net.ParseIP(e.HostIP).Equal(p.listenIP) {
+			continue
+		}
+
+		listenAddr := net.JoinHostPort(p.listenIP.String(), strconv.Itoa(e.HostPort))
+		backendAddr := net.JoinHostPort(args.ContainerIP.String(), strconv.Itoa(e.ContainerPort))
+		pr, err := newProxy(e.Protocol, listenAddr, backendAddr)
+		if err != nil {
+			closeProxies(proxies)
+			return fmt.Errorf("failed to proxy %s %s to %s: %v", e.Protocol, listenAddr, backendAddr, err)
+		}
+		proxies = append(proxies, pr)
+	}
+
+	p.proxies[key] = proxies
+	return nil
+}
+
+// Del stops all proxies of the container.
+func (p *Proxy) Del(args *ProxyArgs, reply *struct{}) error {
+	key := proxyKey(args.Name, args.ContainerID)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	closeProxies(p.proxies[key])
+	delete(p.proxies, key)
+	return nil
+}
+
+func closeProxies(proxies []proxy) {
+	for _, pr := range proxies {
+		pr.Close()
+	}
+}
+
+func getListener() (net.Listener, error) {
+	l, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(l) == 0:
+		if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", socketPath)
+
+	case len(l) == 1:
+		if l[0] == nil {
+			return nil, fmt.Errorf("LISTEN_FDS=1 but no FD found")
+		}
+		return l[0], nil
+
+	default:
+		return nil, fmt.Errorf("Too many (%v) FDs passed through socket activation", len(l))
+	}
+}
+
+func runDaemon(pidfilePath string) error {
+	// Write the pidfile
+	if pidfilePath != "" {
+		if !filepath.IsAbs(pidfilePath) {
+			return fmt.Errorf("Error writing pidfile %q: path not absolute", pidfilePath)
+		}
+		if err := ioutil.WriteFile(pidfilePath, []byte(fmt.Sprintf("%d", os.Getpid())), 0644); err != nil {
+			return fmt.Errorf("Error writing pidfile %q: %v", pidfilePath, err)
+		}
+	}
+
+	l, err := getListener()
+	if err != nil {
+		return fmt.Errorf("Error getting listener: %v", err)
+	}
+
+	rpc.Register(newLocalhostProxy())
+	rpc.HandleHTTP()
+	http.Serve(l, nil)
+	return nil
+}
+
+// rpcCall calls the given method of the proxy daemon.
+func rpcCall(method string, args *ProxyArgs) error {
+	client, err := rpc.DialHTTP("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("error dialing portmap daemon: %v", err)
+	}
+	defer client.Close()
+
+	reply := struct{}{}
+	if err := client.Call(method, args, &reply); err != nil {
+		return fmt.Errorf("error calling %v: %v", method, err)
+	}
+	return nil
+}
+
+// daemonRunning returns true if the proxy daemon's socket can be reached
+func daemonRunning() bool {
+	c, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
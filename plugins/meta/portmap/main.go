@@ -27,8 +27,11 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
 	"net"
+	"os"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -52,6 +55,7 @@ type PortMapConf struct {
 	ConditionsV6         *[]string `json:"conditionsV6"`
 	MarkMasqBit          *int      `json:"markMasqBit"`
 	ExternalSetMarkChain *string   `json:"externalSetMarkChain"`
+	IPv6LocalhostProxy   bool      `json:"ipv6LocalhostProxy,omitempty"`
 	RuntimeConfig        struct {
 		PortMaps []PortMapEntry `json:"portMappings,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
@@ -97,6 +101,25 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 
+	// There is no route_localnet for ipv6, so localhost is handled by
+	// the proxy daemon instead.
+	if netConf.IPv6LocalhostProxy && netConf.ContIPv6 != nil {
+		if err := rpcCall("Proxy.Add", proxyArgs(netConf, netConf.ContIPv6)); err != nil {
+			return err
+		}
+	}
+
+	// Flush UDP flows that still point somewhere else, now that the
+	// DNAT rules are in place. Failure here shouldn't fail the ADD.
+	for _, contIP := range []net.IP{netConf.ContIPv4, netConf.ContIPv6} {
+		if contIP == nil {
+			continue
+		}
+		if err := deleteStaleConnections(netConf.RuntimeConfig.PortMaps, contIP); err != nil {
+			log.Printf("failed to delete stale UDP conntrack entries for %s: %v", contIP, err)
+		}
+	}
+
 	// Pass through the previous result
 	return types.PrintResult(netConf.PrevResult, netConf.CNIVersion)
 }
@@ -114,12 +137,50 @@ func cmdDel(args *skel.CmdArgs) error {
 	if err := unforwardPorts(netConf); err != nil {
 		return err
 	}
+
+	// If the daemon isn't running, there is nothing to tear down.
+	if netConf.IPv6LocalhostProxy && daemonRunning() {
+		if err := rpcCall("Proxy.Del", proxyArgs(netConf, nil)); err != nil {
+			return err
+		}
+	}
+
+	// If we know the container's addresses, also drop its UDP flows.
+	for _, contIP := range []net.IP{netConf.ContIPv4, netConf.ContIPv6} {
+		if contIP == nil {
+			continue
+		}
+		if err := deleteContainerConnections(netConf.RuntimeConfig.PortMaps, contIP); err != nil {
+			log.Printf("failed to delete UDP conntrack entries for %s: %v", contIP, err)
+		}
+	}
 	return nil
 }
 
 func main() {
-	// TODO: implement plugin version
-	skel.PluginMain(cmdAdd, cmdGet, cmdDel, version.All, "TODO")
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		var pidfilePath string
+		daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+		daemonFlags.StringVar(&pidfilePath, "pidfile", "", "optional path to write daemon PID to")
+		daemonFlags.Parse(os.Args[2:])
+
+		if err := runDaemon(pidfilePath); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	} else {
+		// TODO: implement plugin version
+		skel.PluginMain(cmdAdd, cmdGet, cmdDel, version.All, "TODO")
+	}
+}
+
+func proxyArgs(netConf *PortMapConf, containerIP net.IP) *ProxyArgs {
+	return &ProxyArgs{
+		Name:        netConf.Name,
+		ContainerID: netConf.ContainerID,
+		ContainerIP: containerIP,
+		PortMaps:    netConf.RuntimeConfig.PortMaps,
+	}
 }
 
 func cmdGet(args *skel.CmdArgs) error {
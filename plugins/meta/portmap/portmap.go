@@ -167,6 +167,13 @@ func fillDnatRules(c *chain, config *PortMapConf, containerIP net.IP) {
 				"--destination-ports", portSpec,
 			}
 
+			// Local connections to [::1] are left to the proxy, DNAT
+			// would send them to the container with a source address
+			// that can't leave the loopback interface
+			if isV6 && config.IPv6LocalhostProxy {
+				r = append(r, "!", "-d", "::1")
+			}
+
 			if isV6 && config.ConditionsV6 != nil && len(*config.ConditionsV6) > 0 {
 				r = append(r, *config.ConditionsV6...)
 			} else if !isV6 && config.ConditionsV4 != nil && len(*config.ConditionsV4) > 0 {
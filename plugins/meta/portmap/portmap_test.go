@@ -284,6 +284,47 @@ var _ = Describe("portmapping configuration", func() {
 				}))
 			})
 
+			It("leaves ::1 to the proxy with ipv6LocalhostProxy", func() {
+				configBytes := []byte(`{
+	"name": "test",
+	"type": "portmap",
+	"cniVersion": "0.3.1",
+	"runtimeConfig": {
+		"portMappings": [
+			{ "hostPort": 8080, "containerPort": 80, "protocol": "tcp"}
+		]
+	},
+	"ipv6LocalhostProxy": true,
+	"conditionsV6": ["c", "d"]
+}`)
+
+				conf, err := parseConfig(configBytes, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				conf.ContainerID = containerID
+				comment := fmt.Sprintf("dnat name: \"test\" id: \"%s\"", containerID)
+
+				ch := genDnatChain(conf.Name, containerID)
+				fillDnatRules(&ch, conf, net.ParseIP("2001:db8::2"))
+				Expect(ch.entryRules).To(Equal([][]string{
+					{"-m", "comment", "--comment", comment,
+						"-m", "multiport",
+						"-p", "tcp",
+						"--destination-ports", "8080",
+						"!", "-d", "::1",
+						"c", "d"},
+				}))
+
+				// IPv4 localhost is DNATed with route_localnet
+				ch = genDnatChain(conf.Name, containerID)
+				fillDnatRules(&ch, conf, net.ParseIP("10.0.0.2"))
+				Expect(ch.entryRules).To(Equal([][]string{
+					{"-m", "comment", "--comment", comment,
+						"-m", "multiport",
+						"-p", "tcp",
+						"--destination-ports", "8080"},
+				}))
+			})
+
 			It("generates a correct top-level chain", func() {
 				ch := genToplevelDnatChain()
 
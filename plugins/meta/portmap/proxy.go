@@ -0,0 +1,263 @@
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kernel will not route packets from ::1 to another interface, so there
+// is no ipv6 equivalent of route_localnet + MASQUERADE. Instead, the daemon
+// runs a small userspace proxy per mapping that listens on [::1]:hostPort
+// and relays to the container.
+
+// How long a UDP "session" is kept without any traffic
+const udpIdleTimeout = 90 * time.Second
+
+const udpBufSize = 65535
+
+type proxy interface {
+	Close() error
+}
+
+// newProxy starts relaying proto traffic from listenAddr to backendAddr.
+func newProxy(proto, listenAddr, backendAddr string) (proxy, error) {
+	switch strings.ToLower(proto) {
+	case "tcp":
+		return newTCPProxy(listenAddr, backendAddr)
+	case "udp":
+		return newUDPProxy(listenAddr, backendAddr)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", proto)
+	}
+}
+
+type tcpProxy struct {
+	listener net.Listener
+	backend  string
+
+	mux   sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTCPProxy(listenAddr, backendAddr string) (*tcpProxy, error) {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &tcpProxy{
+		listener: l,
+		backend:  backendAddr,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *tcpProxy) run() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			// The listener was closed
+			return
+		}
+		go p.relay(client)
+	}
+}
+
+func (p *tcpProxy) relay(client net.Conn) {
+	defer client.Close()
+
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		log.Printf("proxy %s: failed to connect to %s: %v", p.listener.Addr(), p.backend, err)
+		return
+	}
+	defer backend.Close()
+
+	if !p.track(client, backend) {
+		return
+	}
+	defer p.untrack(client, backend)
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if c, ok := dst.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(backend, client)
+	go copyHalf(client, backend)
+	<-done
+	<-done
+}
+
+// track records the connections so they can be closed with the proxy. It
+// returns false if the proxy has already been closed.
+func (p *tcpProxy) track(conns ...net.Conn) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.conns == nil {
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (p *tcpProxy) untrack(conns ...net.Conn) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+// Close stops listening and terminates all relayed connections.
+func (p *tcpProxy) Close() error {
+	err := p.listener.Close()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+
+	return err
+}
+
+type udpProxy struct {
+	conn    net.PacketConn
+	backend *net.UDPAddr
+
+	mux     sync.Mutex
+	clients map[string]*net.UDPConn
+}
+
+func newUDPProxy(listenAddr, backendAddr string) (*udpProxy, error) {
+	backend, err := net.ResolveUDPAddr("udp", backendAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &udpProxy{
+		conn:    conn,
+		backend: backend,
+		clients: make(map[string]*net.UDPConn),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *udpProxy) run() {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, clientAddr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			// The listener was closed
+			return
+		}
+
+		backend, err := p.getClient(clientAddr)
+		if err != nil {
+			log.Printf("proxy %s: failed to connect to %s: %v", p.conn.LocalAddr(), p.backend, err)
+			continue
+		}
+		if _, err := backend.Write(buf[:n]); err != nil {
+			log.Printf("proxy %s: failed to write to %s: %v", p.conn.LocalAddr(), p.backend, err)
+		}
+	}
+}
+
+// getClient returns the connection to the backend used for the given
+// client, creating it if needed.
+func (p *udpProxy) getClient(clientAddr net.Addr) (*net.UDPConn, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.clients == nil {
+		return nil, fmt.Errorf("proxy closed")
+	}
+
+	key := clientAddr.String()
+	if backend, ok := p.clients[key]; ok {
+		return backend, nil
+	}
+
+	backend, err := net.DialUDP("udp", nil, p.backend)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = backend
+	go p.replyLoop(key, clientAddr, backend)
+	return backend, nil
+}
+
+// replyLoop relays replies from the backend to the client, until the
+// session is idle for udpIdleTimeout.
+func (p *udpProxy) replyLoop(key string, clientAddr net.Addr, backend *net.UDPConn) {
+	defer func() {
+		p.mux.Lock()
+		if p.clients != nil {
+			delete(p.clients, key)
+		}
+		p.mux.Unlock()
+		backend.Close()
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := p.conn.WriteTo(buf[:n], clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops listening and terminates all sessions.
+func (p *udpProxy) Close() error {
+	err := p.conn.Close()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, c := range p.clients {
+		c.Close()
+	}
+	p.clients = nil
+
+	return err
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// tcpEcho starts a tcp echo server on localhost and returns its address
+func tcpEcho() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// udpEcho starts a udp echo server on localhost and returns its address
+func udpEcho() net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// freePort returns a port number that is currently unused on localhost
+func freePort() int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func expectTCPEcho(addr string) {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	Expect(err).NotTo(HaveOccurred())
+	defer c.Close()
+
+	_, err = c.Write([]byte("hello\n"))
+	Expect(err).NotTo(HaveOccurred())
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	Expect(err).NotTo(HaveOccurred())
+	Expect(line).To(Equal("hello\n"))
+}
+
+var _ = Describe("localhost proxy", func() {
+	It("relays tcp connections", func() {
+		backend := tcpEcho()
+		defer backend.Close()
+
+		p, err := newProxy("tcp", "127.0.0.1:0", backend.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+
+		addr := p.(*tcpProxy).listener.Addr().String()
+		expectTCPEcho(addr)
+
+		Expect(p.Close()).To(Succeed())
+		_, err = net.DialTimeout("tcp", addr, time.Second)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("relays udp datagrams", func() {
+		backend := udpEcho()
+		defer backend.Close()
+
+		p, err := newProxy("UDP", "127.0.0.1:0", backend.LocalAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer p.Close()
+
+		c, err := net.Dial("udp", p.(*udpProxy).conn.LocalAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer c.Close()
+
+		for _, msg := range []string{"one", "two"} {
+			_, err = c.Write([]byte(msg))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 100)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := c.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal(msg))
+		}
+		Expect(p.(*udpProxy).clients).To(HaveLen(1))
+	})
+
+	It("rejects unknown protocols", func() {
+		_, err := newProxy("sctp", "127.0.0.1:0", "127.0.0.1:1")
+		Expect(err).To(MatchError(`unsupported protocol "sctp"`))
+	})
+
+	It("adds and removes the proxies of a container", func() {
+		backend := tcpEcho()
+		defer backend.Close()
+		backendPort := backend.Addr().(*net.TCPAddr).Port
+
+		d := newLocalhostProxy()
+		d.listenIP = net.ParseIP("127.0.0.1")
+
+		hostPort := freePort()
+		args := &ProxyArgs{
+			Name:        "testnet",
+			ContainerID: "ctr1",
+			ContainerIP: net.ParseIP("127.0.0.1"),
+			PortMaps: []PortMapEntry{
+				{HostPort: hostPort, ContainerPort: backendPort, Protocol: "tcp"},
+				// not reachable via localhost, skipped
+				{HostPort: hostPort, ContainerPort: backendPort, Protocol: "tcp", HostIP: "192.0.2.1"},
+			},
+		}
+		Expect(d.Add(args, &struct{}{})).To(Succeed())
+		Expect(d.proxies[proxyKey("testnet", "ctr1")]).To(HaveLen(1))
+
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort))
+		expectTCPEcho(addr)
+
+		// re-adding replaces the existing proxies
+		Expect(d.Add(args, &struct{}{})).To(Succeed())
+		expectTCPEcho(addr)
+
+		Expect(d.Del(args, &struct{}{})).To(Succeed())
+		Expect(d.proxies).To(BeEmpty())
+		_, err := net.DialTimeout("tcp", addr, time.Second)
+		Expect(err).To(HaveOccurred())
+
+		// idempotent
+		Expect(d.Del(args, &struct{}{})).To(Succeed())
+	})
+})
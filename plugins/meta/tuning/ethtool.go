@@ -0,0 +1,272 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"syscall"
+	"unsafe"
+
+	"github.com/safchain/ethtool"
+)
+
+// The vendored ethtool package can only read driver info and statistics, so
+// the feature ioctls (`ethtool -k` / `ethtool -K`) are implemented here.
+
+const (
+	ethSSFeatures       = 4
+	ethtoolCmdGSSetInfo = 0x00000037
+	ethtoolCmdGFeatures = 0x0000003a
+	ethtoolCmdSFeatures = 0x0000003b
+	ethtoolFWish        = 1 << 0
+	maxFeatures         = 256
+	maxFeatureBlocks    = maxFeatures / 32
+	featureNameLength   = ethtool.ETH_GSTRING_LEN
+)
+
+// EthtoolConf represents the ethtool settings of the container interface
+type EthtoolConf struct {
+	// Features maps kernel feature names, as listed by `ethtool -k`, to
+	// whether they should be on or off.
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+type ethtoolSSetInfo struct {
+	cmd      uint32
+	reserved uint32
+	mask     uint64
+	data     [1]uint32
+}
+
+type ethtoolFeatureNames struct {
+	cmd       uint32
+	stringSet uint32
+	len       uint32
+	data      [maxFeatures * featureNameLength]byte
+}
+
+type ethtoolGetFeaturesBlock struct {
+	available    uint32
+	requested    uint32
+	active       uint32
+	neverChanged uint32
+}
+
+type ethtoolGFeatures struct {
+	cmd    uint32
+	size   uint32
+	blocks [maxFeatureBlocks]ethtoolGetFeaturesBlock
+}
+
+type ethtoolSetFeaturesBlock struct {
+	valid     uint32
+	requested uint32
+}
+
+type ethtoolSFeatures struct {
+	cmd    uint32
+	size   uint32
+	blocks [maxFeatureBlocks]ethtoolSetFeaturesBlock
+}
+
+type ifreq struct {
+	name [ethtool.IFNAMSIZ]byte
+	data uintptr
+}
+
+type featureSet struct {
+	fd     int
+	ifName string
+	names  map[string]int
+	size   uint32
+	blocks [maxFeatureBlocks]ethtoolGetFeaturesBlock
+}
+
+func (f *featureSet) ioctl(data unsafe.Pointer) (uintptr, error) {
+	ifr := ifreq{data: uintptr(data)}
+	copy(ifr.name[:], f.ifName)
+	r, _, ep := syscall.Syscall(syscall.SYS_IOCTL, uintptr(f.fd), ethtool.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	if ep != 0 {
+		return 0, ep
+	}
+	return r, nil
+}
+
+// getFeatures reads the names and states of the features of the interface
+func getFeatures(fd int, ifName string) (*featureSet, error) {
+	f := &featureSet{fd: fd, ifName: ifName, names: map[string]int{}}
+
+	info := ethtoolSSetInfo{cmd: ethtoolCmdGSSetInfo, mask: 1 << ethSSFeatures}
+	if _, err := f.ioctl(unsafe.Pointer(&info)); err != nil {
+		return nil, err
+	}
+	count := info.data[0]
+	if count > maxFeatures {
+		return nil, fmt.Errorf("%q has %d features, at most %d are supported", ifName, count, maxFeatures)
+	}
+
+	names := ethtoolFeatureNames{cmd: ethtool.ETHTOOL_GSTRINGS, stringSet: ethSSFeatures, len: count}
+	if _, err := f.ioctl(unsafe.Pointer(&names)); err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(count); i++ {
+		b := names.data[i*featureNameLength : (i+1)*featureNameLength]
+		name := string(bytes.Trim(b, "\x00"))
+		if name != "" {
+			f.names[name] = i
+		}
+	}
+
+	features := ethtoolGFeatures{cmd: ethtoolCmdGFeatures, size: maxFeatureBlocks}
+	if _, err := f.ioctl(unsafe.Pointer(&features)); err != nil {
+		return nil, err
+	}
+	// The kernel reports the number of blocks it has, which is also the
+	// only size it accepts when setting features
+	if features.size > maxFeatureBlocks {
+		return nil, fmt.Errorf("%q has %d feature blocks, at most %d are supported", ifName, features.size, maxFeatureBlocks)
+	}
+	f.size = features.size
+	f.blocks = features.blocks
+	return f, nil
+}
+
+// active returns whether the feature is on
+func (f *featureSet) active(name string) bool {
+	i := f.names[name]
+	return f.blocks[i/32].active&(1<<uint(i%32)) != 0
+}
+
+// check returns an error if the feature is unknown
+func (f *featureSet) check(name string) error {
+	if _, ok := f.names[name]; !ok {
+		return fmt.Errorf("ethtool feature %q is not supported by %q", name, f.ifName)
+	}
+	return nil
+}
+
+// fixed returns whether the feature cannot be changed
+func (f *featureSet) fixed(name string) bool {
+	i := f.names[name]
+	bit := uint32(1) << uint(i%32)
+	block := f.blocks[i/32]
+	return block.available&bit == 0 || block.neverChanged&bit != 0
+}
+
+// set requests the given feature states
+func (f *featureSet) set(features map[string]bool) error {
+	req := ethtoolSFeatures{cmd: ethtoolCmdSFeatures, size: f.size}
+	for name, on := range features {
+		i := f.names[name]
+		bit := uint32(1) << uint(i%32)
+		req.blocks[i/32].valid |= bit
+		if on {
+			req.blocks[i/32].requested |= bit
+		}
+	}
+	r, err := f.ioctl(unsafe.Pointer(&req))
+	if err != nil {
+		return err
+	}
+	if r&ethtoolFWish == 0 {
+		return nil
+	}
+
+	// Some of the requested features could not be applied, e.g. because
+	// they depend on another feature
+	current, err := getFeatures(f.fd, f.ifName)
+	if err != nil {
+		return err
+	}
+	failed := []string{}
+	for name, on := range features {
+		if current.active(name) != on {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("ethtool features %v could not be changed on %q", failed, f.ifName)
+	}
+	return nil
+}
+
+func ethtoolSocket() (int, error) {
+	return syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+}
+
+// getEthtoolFeatures returns the current state of the named features. It
+// must be called in the network namespace of the interface.
+func getEthtoolFeatures(ifName string, names map[string]bool) (map[string]bool, error) {
+	fd, err := ethtoolSocket()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	f, err := getFeatures(fd, ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ethtool features of %q: %v", ifName, err)
+	}
+	states := map[string]bool{}
+	for name := range names {
+		if err := f.check(name); err != nil {
+			return nil, err
+		}
+		states[name] = f.active(name)
+	}
+	return states, nil
+}
+
+// setEthtoolFeatures turns the named features on or off. It must be called
+// in the network namespace of the interface.
+func setEthtoolFeatures(ifName string, features map[string]bool) error {
+	if len(features) == 0 {
+		return nil
+	}
+
+	fd, err := ethtoolSocket()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	f, err := getFeatures(fd, ifName)
+	if err != nil {
+		return fmt.Errorf("failed to get ethtool features of %q: %v", ifName, err)
+	}
+	changes := map[string]bool{}
+	for name, on := range features {
+		if err := f.check(name); err != nil {
+			return err
+		}
+		if f.active(name) == on {
+			continue
+		}
+		if f.fixed(name) {
+			return fmt.Errorf("ethtool feature %q is fixed on %q", name, ifName)
+		}
+		changes[name] = on
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := f.set(changes); err != nil {
+		return fmt.Errorf("failed to set ethtool features of %q: %v", ifName, err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The vendored netlink cannot set the allmulticast flag or the transmit
+// queue length, so the requests are built here.
+
+// setAllMulticast is equivalent to `ip link set $link allmulticast on|off`
+func setAllMulticast(link netlink.Link, on bool) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Change = syscall.IFF_ALLMULTI
+	if on {
+		msg.Flags = syscall.IFF_ALLMULTI
+	}
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// setTxQLen is equivalent to `ip link set $link txqueuelen $qlen`
+func setTxQLen(link netlink.Link, qlen int) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.IFLA_TXQLEN, nl.Uint32Attr(uint32(qlen))))
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// setPromisc is equivalent to `ip link set $link promisc on|off`
+func setPromisc(link netlink.Link, on bool) error {
+	if on {
+		return netlink.SetPromiscOn(link)
+	}
+	return netlink.SetPromiscOff(link)
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+)
+
+// The policy is read from a fixed location on the host, so that it cannot be
+// changed by whoever provides the network configuration.
+var defaultPolicyPath = "/etc/cni/tuning/sysctl-policy.json"
+
+// SysctlRule matches sysctl keys with a glob, and optionally their values
+// with a regular expression.
+type SysctlRule struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+
+	key   string
+	value *regexp.Regexp
+}
+
+// SysctlPolicy restricts the sysctls the plugin may write. Deny rules take
+// precedence. If there are allow rules, a sysctl must match one of them.
+type SysctlPolicy struct {
+	Allow []*SysctlRule `json:"allow,omitempty"`
+	Deny  []*SysctlRule `json:"deny,omitempty"`
+
+	path string
+}
+
+// loadPolicy reads the policy file. Without a policy file, any network sysctl
+// may be written.
+func loadPolicy(policyPath string) (*SysctlPolicy, error) {
+	data, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read sysctl policy: %v", err)
+	}
+
+	policy := &SysctlPolicy{path: policyPath}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse sysctl policy %q: %v", policyPath, err)
+	}
+	for _, r := range append(policy.Allow, policy.Deny...) {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("invalid rule %s in sysctl policy %q: %v", r, policyPath, err)
+		}
+	}
+	return policy, nil
+}
+
+func (r *SysctlRule) compile() error {
+	if r.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	key, err := canonicalSysctlKey(r.Key)
+	if err != nil {
+		return err
+	}
+	if _, err := path.Match(key, ""); err != nil {
+		return err
+	}
+	r.key = key
+	if r.Value != "" {
+		re, err := regexp.Compile("^(?:" + r.Value + ")$")
+		if err != nil {
+			return err
+		}
+		r.value = re
+	}
+	return nil
+}
+
+// matches takes the canonical key, see canonicalSysctlKey
+func (r *SysctlRule) matches(key, value string) bool {
+	// The glob is matched against the key with "/" separators, so that "*"
+	// stands for a single component
+	ok, _ := path.Match(r.key, key)
+	if !ok {
+		return false
+	}
+	return r.value == nil || r.value.MatchString(value)
+}
+
+func (r *SysctlRule) String() string {
+	if r.Value == "" {
+		return fmt.Sprintf("{key: %q}", r.Key)
+	}
+	return fmt.Sprintf("{key: %q, value: %q}", r.Key, r.Value)
+}
+
+// check returns an error naming the rule that blocks writing value to key
+func (p *SysctlPolicy) check(key, value string) error {
+	if p == nil {
+		return nil
+	}
+	// Match the rules against the file that is written, whatever the
+	// spelling of the key
+	canonical, err := canonicalSysctlKey(key)
+	if err != nil {
+		return err
+	}
+	for _, r := range p.Deny {
+		if r.matches(canonical, value) {
+			return fmt.Errorf("sysctl %q=%q is denied by rule %s of %q", key, value, r, p.path)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, r := range p.Allow {
+		if r.matches(canonical, value) {
+			return nil
+		}
+	}
+	return fmt.Errorf("sysctl %q=%q is not allowed by any rule of %q", key, value, p.path)
+}
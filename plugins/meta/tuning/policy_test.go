@@ -0,0 +1,139 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sysctl policy", func() {
+	var dir, policyPath string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tuning-policy")
+		Expect(err).NotTo(HaveOccurred())
+		policyPath = filepath.Join(dir, "sysctl-policy.json")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writePolicy := func(policy string) *SysctlPolicy {
+		Expect(ioutil.WriteFile(policyPath, []byte(policy), 0644)).To(Succeed())
+		p, err := loadPolicy(policyPath)
+		Expect(err).NotTo(HaveOccurred())
+		return p
+	}
+
+	It("allows everything without a policy file", func() {
+		p, err := loadPolicy(policyPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.check("net.ipv4.ip_forward", "1")).To(Succeed())
+	})
+
+	It("reports the deny rule that matched", func() {
+		p := writePolicy(`{
+	"deny": [
+		{"key": "net.ipv4.ip_forward"},
+		{"key": "net.ipv4.conf.all.*"}
+	]
+}`)
+		Expect(p.check("net.ipv4.ip_forward", "1")).To(MatchError(`sysctl "net.ipv4.ip_forward"="1" is denied by rule {key: "net.ipv4.ip_forward"} of "` + policyPath + `"`))
+		Expect(p.check("net.ipv4.conf.all.rp_filter", "0")).To(MatchError(ContainSubstring(`rule {key: "net.ipv4.conf.all.*"}`)))
+		Expect(p.check("net.ipv4.conf.eth0.rp_filter", "0")).To(Succeed())
+	})
+
+	It("only allows matching keys and values if there are allow rules", func() {
+		p := writePolicy(`{
+	"allow": [
+		{"key": "net.core.somaxconn"},
+		{"key": "net.ipv4.conf.*.rp_filter", "value": "[0-2]"}
+	],
+	"deny": [
+		{"key": "net.ipv4.conf.all.*"}
+	]
+}`)
+		Expect(p.check("net.core.somaxconn", "500")).To(Succeed())
+		Expect(p.check("net.ipv4.conf.eth0.rp_filter", "2")).To(Succeed())
+		Expect(p.check("net.ipv4.conf.eth0.rp_filter", "12")).To(MatchError(`sysctl "net.ipv4.conf.eth0.rp_filter"="12" is not allowed by any rule of "` + policyPath + `"`))
+		Expect(p.check("net.ipv4.conf.all.rp_filter", "1")).To(MatchError(ContainSubstring("is denied by rule")))
+		// "*" only stands for a single component
+		Expect(p.check("net.ipv4.conf.eth0.foo.rp_filter", "1")).To(MatchError(ContainSubstring("is not allowed")))
+	})
+
+	It("can't be bypassed by other spellings of a denied key", func() {
+		p := writePolicy(`{
+	"deny": [
+		{"key": "net.ipv4.ip_forward"},
+		{"key": "net.ipv4.conf.all.*"}
+	]
+}`)
+		Expect(p.check("net/ipv4/ip_forward", "1")).To(MatchError(ContainSubstring("is denied by rule")))
+		Expect(p.check("net/ipv4/conf/all/rp_filter", "0")).To(MatchError(ContainSubstring("is denied by rule")))
+		for _, key := range []string{
+			"net/ipv4//ip_forward",
+			"net/ipv4/./ip_forward",
+			"net/ipv4/conf/../ip_forward",
+			"net/ipv4/conf/eth0/../all/rp_filter",
+			"/net/ipv4/ip_forward",
+			"net/ipv4/ip_forward/",
+			"net..ipv4.ip_forward",
+		} {
+			Expect(p.check(key, "1")).To(MatchError(`invalid sysctl key "`+key+`"`), key)
+		}
+	})
+
+	It("rejects invalid rules", func() {
+		Expect(ioutil.WriteFile(policyPath, []byte(`{"allow": [{"key": "net.core.*", "value": "("}]}`), 0644)).To(Succeed())
+		_, err := loadPolicy(policyPath)
+		Expect(err).To(MatchError(HavePrefix(`invalid rule {key: "net.core.*", value: "("}`)))
+
+		Expect(ioutil.WriteFile(policyPath, []byte(`{"deny": [{"key": "net/ipv4/../core/*"}]}`), 0644)).To(Succeed())
+		_, err = loadPolicy(policyPath)
+		Expect(err).To(MatchError(HavePrefix(`invalid rule {key: "net/ipv4/../core/*"}`)))
+	})
+
+	It("is enforced by ADD", func() {
+		writePolicy(`{"deny": [{"key": "net.ipv4.ip_forward"}]}`)
+		origPolicyPath := defaultPolicyPath
+		defaultPolicyPath = policyPath
+		defer func() { defaultPolicyPath = origPolicyPath }()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/does-not-exist",
+			IfName:      "eth0",
+			StdinData: []byte(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"sysctl": {
+		"net.ipv4.ip_forward": "1"
+	}
+}`),
+		}
+		err := cmdAdd(args)
+		Expect(err).To(MatchError(ContainSubstring("is denied by rule")))
+	})
+})
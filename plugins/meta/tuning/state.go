@@ -0,0 +1,141 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+var defaultDataDir = "/run/cni/tuning"
+
+// tuningState holds the values the container had before ADD changed them,
+// so that DEL can restore them.
+type tuningState struct {
+	SysCtl  map[string]string `json:"sysctl,omitempty"`
+	Link    LinkConf          `json:"link"`
+	Ethtool map[string]bool   `json:"ethtool,omitempty"`
+}
+
+func statePath(dataDir, network, containerID string) string {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	return filepath.Join(dataDir, network, containerID+".json")
+}
+
+// loadState reads the state file, returning an empty state if there is none.
+func loadState(path string) (*tuningState, error) {
+	state := &tuningState{SysCtl: map[string]string{}, Ethtool: map[string]bool{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read tuning state: %v", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse tuning state %q: %v", path, err)
+	}
+	if state.SysCtl == nil {
+		state.SysCtl = map[string]string{}
+	}
+	if state.Ethtool == nil {
+		state.Ethtool = map[string]bool{}
+	}
+	return state, nil
+}
+
+func saveState(path string, state *tuningState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create tuning state directory: %v", err)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write tuning state: %v", err)
+	}
+	return nil
+}
+
+// saveSysctl records the current value of the sysctl, unless a previous ADD
+// already recorded its original value.
+func (s *tuningState) saveSysctl(key, fileName string) error {
+	if _, ok := s.SysCtl[key]; ok {
+		return nil
+	}
+	value, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	s.SysCtl[key] = strings.TrimSpace(string(value))
+	return nil
+}
+
+// saveLink records the current values of the link attributes that conf
+// changes, unless a previous ADD already recorded them.
+func (s *tuningState) saveLink(link netlink.Link, conf *LinkConf) {
+	attrs := link.Attrs()
+	if conf.Mac != "" && s.Link.Mac == "" {
+		s.Link.Mac = attrs.HardwareAddr.String()
+	}
+	if conf.Mtu != 0 && s.Link.Mtu == 0 {
+		s.Link.Mtu = attrs.MTU
+	}
+	if conf.Promisc != nil && s.Link.Promisc == nil {
+		promisc := attrs.Promisc != 0
+		s.Link.Promisc = &promisc
+	}
+	if conf.AllMulti != nil && s.Link.AllMulti == nil {
+		allMulti := attrs.RawFlags&syscall.IFF_ALLMULTI != 0
+		s.Link.AllMulti = &allMulti
+	}
+	if conf.TxQLen != nil && s.Link.TxQLen == nil {
+		txQLen := attrs.TxQLen
+		s.Link.TxQLen = &txQLen
+	}
+}
+
+// saveEthtool records the current state of the ethtool features, unless a
+// previous ADD already recorded them.
+func (s *tuningState) saveEthtool(ifName string, features map[string]bool) error {
+	missing := map[string]bool{}
+	for name := range features {
+		if _, ok := s.Ethtool[name]; !ok {
+			missing[name] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	current, err := getEthtoolFeatures(ifName, missing)
+	if err != nil {
+		return err
+	}
+	for name, on := range current {
+		s.Ethtool[name] = on
+	}
+	return nil
+}
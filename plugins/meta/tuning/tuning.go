@@ -13,7 +13,8 @@
 // limitations under the License.
 
 // This is a "meta-plugin". It reads in its own netconf, it does not create
-// any network interface but just changes the network sysctl.
+// any network interface but just changes the network sysctl and the
+// attributes of the container interface.
 
 package main
 
@@ -21,7 +22,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
@@ -29,12 +33,32 @@ import (
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/vishvananda/netlink"
 )
 
+// LinkConf represents the attributes of the container interface to change.
+// Unset attributes are left alone.
+type LinkConf struct {
+	Mac      string `json:"mac,omitempty"`
+	Mtu      int    `json:"mtu,omitempty"`
+	Promisc  *bool  `json:"promisc,omitempty"`
+	AllMulti *bool  `json:"allmulti,omitempty"`
+	TxQLen   *int   `json:"txQLen,omitempty"`
+}
+
+func (c *LinkConf) isEmpty() bool {
+	return c.Mac == "" && c.Mtu == 0 && c.Promisc == nil && c.AllMulti == nil && c.TxQLen == nil
+}
+
 // TuningConf represents the network tuning configuration.
 type TuningConf struct {
 	types.NetConf
-	SysCtl        map[string]string      `json:"sysctl"`
+	SysCtl map[string]string `json:"sysctl"`
+	LinkConf
+	Ethtool       EthtoolConf            `json:"ethtool,omitempty"`
+	DataDir       string                 `json:"dataDir,omitempty"`
+	RuntimeConfig *LinkConf              `json:"runtimeConfig,omitempty"`
 	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
 	PrevResult    *current.Result        `json:"-"`
 }
@@ -62,50 +86,331 @@ func parseConf(data []byte) (*TuningConf, error) {
 		}
 	}
 
+	// The runtime config takes precedence
+	if rc := conf.RuntimeConfig; rc != nil {
+		if rc.Mac != "" {
+			conf.Mac = rc.Mac
+		}
+		if rc.Mtu != 0 {
+			conf.Mtu = rc.Mtu
+		}
+		if rc.Promisc != nil {
+			conf.Promisc = rc.Promisc
+		}
+		if rc.AllMulti != nil {
+			conf.AllMulti = rc.AllMulti
+		}
+		if rc.TxQLen != nil {
+			conf.TxQLen = rc.TxQLen
+		}
+	}
+
+	if conf.Mac != "" {
+		if _, err := net.ParseMAC(conf.Mac); err != nil {
+			return nil, fmt.Errorf("invalid mac %q: %v", conf.Mac, err)
+		}
+	}
+	if conf.Mtu < 0 {
+		return nil, fmt.Errorf("invalid mtu %d", conf.Mtu)
+	}
+	if conf.TxQLen != nil && *conf.TxQLen < 0 {
+		return nil, fmt.Errorf("invalid txQLen %d", *conf.TxQLen)
+	}
+
 	return &conf, nil
 }
 
+// changeLinkAttrs applies the link settings of the configuration to the
+// interface. It must be called in the network namespace of the interface.
+func changeLinkAttrs(ifName string, conf *LinkConf) error {
+	if conf.isEmpty() {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	if conf.Mtu != 0 {
+		if err := netlink.LinkSetMTU(link, conf.Mtu); err != nil {
+			return fmt.Errorf("failed to set %q mtu to %d: %v", ifName, conf.Mtu, err)
+		}
+	}
+	if conf.Mac != "" {
+		hwaddr, err := net.ParseMAC(conf.Mac)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetHardwareAddr(link, hwaddr); err != nil {
+			return fmt.Errorf("failed to set %q mac to %s: %v", ifName, hwaddr, err)
+		}
+	}
+	if conf.Promisc != nil {
+		if err := setPromisc(link, *conf.Promisc); err != nil {
+			return fmt.Errorf("failed to set %q promiscuous mode: %v", ifName, err)
+		}
+	}
+	if conf.AllMulti != nil {
+		if err := setAllMulticast(link, *conf.AllMulti); err != nil {
+			return fmt.Errorf("failed to set %q allmulticast mode: %v", ifName, err)
+		}
+	}
+	if conf.TxQLen != nil {
+		if err := setTxQLen(link, *conf.TxQLen); err != nil {
+			return fmt.Errorf("failed to set %q txqueuelen to %d: %v", ifName, *conf.TxQLen, err)
+		}
+	}
+	return nil
+}
+
+// updateResultMac records the new MAC address of the container interface in
+// the result, so that later plugins see the actual address.
+func updateResultMac(result *current.Result, ifName, mac string) {
+	if result == nil {
+		return
+	}
+	hwaddr, _ := net.ParseMAC(mac)
+	for _, iface := range result.Interfaces {
+		// Host interfaces have no sandbox
+		if iface.Name == ifName && iface.Sandbox != "" {
+			iface.Mac = hwaddr.String()
+		}
+	}
+}
+
+// ifNamePlaceholder is replaced by the name of the container interface in
+// sysctl keys
+const ifNamePlaceholder = "IFNAME"
+
+// normalizeSysctlKey converts a sysctl key to its "/" separated form. Keys
+// that already contain a "/" are "/" separated, and their dots are part of
+// the components, like the dot in the interface name eth0.100.
+func normalizeSysctlKey(key string) string {
+	if strings.Contains(key, "/") {
+		return key
+	}
+	return strings.Replace(key, ".", "/", -1)
+}
+
+// expandSysctlKey returns the canonical key with the IFNAME placeholder
+// replaced by ifName, see canonicalSysctlKey.
+func expandSysctlKey(key, ifName string) (string, error) {
+	components := strings.Split(normalizeSysctlKey(key), "/")
+	for i, c := range components {
+		if c == ifNamePlaceholder {
+			components[i] = ifName
+		}
+	}
+	return canonicalSysctlKey(strings.Join(components, "/"))
+}
+
+// expandSysctls expands the keys of the sysctls for the interface. The
+// expanded keys are canonical, so that the policy is checked for the files
+// that are written.
+func expandSysctls(sysctls map[string]string, ifName string) (map[string]string, error) {
+	expanded := make(map[string]string, len(sysctls))
+	for key, value := range sysctls {
+		k, err := expandSysctlKey(key, ifName)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := expanded[k]; ok {
+			return nil, fmt.Errorf("sysctl key %q is set more than once", k)
+		}
+		expanded[k] = value
+	}
+	return expanded, nil
+}
+
+// canonicalSysctlKey returns the "/" separated key, which is the path of the
+// sysctl relative to /proc/sys. Empty, "." and ".." components are refused,
+// so that the file written is always the one the policy was checked for.
+func canonicalSysctlKey(key string) (string, error) {
+	components := strings.Split(normalizeSysctlKey(key), "/")
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." {
+			return "", fmt.Errorf("invalid sysctl key %q", key)
+		}
+	}
+	return strings.Join(components, "/"), nil
+}
+
+// sysctlPath returns the file of the sysctl key, refusing sysctl parameters
+// that don't belong to the network subsystem.
+func sysctlPath(key string) (string, error) {
+	canonical, err := canonicalSysctlKey(key)
+	if err != nil {
+		return "", err
+	}
+	fileName := filepath.Join("/proc/sys", canonical)
+	if !strings.HasPrefix(fileName, "/proc/sys/net/") {
+		return "", fmt.Errorf("invalid net sysctl key: %q", key)
+	}
+	return fileName, nil
+}
+
+// saveOriginals records the values ADD is about to change in the state file.
+// It must be called in the network namespace of the container.
+func saveOriginals(statePath, ifName string, tuningConf *TuningConf) error {
+	if len(tuningConf.SysCtl) == 0 && tuningConf.LinkConf.isEmpty() && len(tuningConf.Ethtool.Features) == 0 {
+		return nil
+	}
+
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+	for key := range tuningConf.SysCtl {
+		fileName, err := sysctlPath(key)
+		if err != nil {
+			return err
+		}
+		if err := state.saveSysctl(key, fileName); err != nil {
+			return err
+		}
+	}
+	if !tuningConf.LinkConf.isEmpty() {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		state.saveLink(link, &tuningConf.LinkConf)
+	}
+	if err := state.saveEthtool(ifName, tuningConf.Ethtool.Features); err != nil {
+		return err
+	}
+	return saveState(statePath, state)
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 	tuningConf, err := parseConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	tuningConf.SysCtl, err = expandSysctls(tuningConf.SysCtl, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// Enforce the administrator's policy before changing anything
+	policy, err := loadPolicy(defaultPolicyPath)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(tuningConf.SysCtl))
+	for key := range tuningConf.SysCtl {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := policy.check(key, tuningConf.SysCtl[key]); err != nil {
+			return err
+		}
+	}
+
 	// The directory /proc/sys/net is per network namespace. Enter in the
 	// network namespace before writing on it.
 
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		for key, value := range tuningConf.SysCtl {
-			fileName := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
-			fileName = filepath.Clean(fileName)
+		// Keep the original values so that DEL can restore them
+		path := statePath(tuningConf.DataDir, tuningConf.Name, args.ContainerID)
+		if err := saveOriginals(path, args.IfName, tuningConf); err != nil {
+			return err
+		}
 
-			// Refuse to modify sysctl parameters that don't belong
-			// to the network subsystem.
-			if !strings.HasPrefix(fileName, "/proc/sys/net/") {
-				return fmt.Errorf("invalid net sysctl key: %q", key)
+		for key, value := range tuningConf.SysCtl {
+			fileName, err := sysctlPath(key)
+			if err != nil {
+				return err
 			}
 			content := []byte(value)
-			err := ioutil.WriteFile(fileName, content, 0644)
+			err = ioutil.WriteFile(fileName, content, 0644)
 			if err != nil {
 				return err
 			}
 		}
-		return nil
+
+		if err := changeLinkAttrs(args.IfName, &tuningConf.LinkConf); err != nil {
+			return err
+		}
+		return setEthtoolFeatures(args.IfName, tuningConf.Ethtool.Features)
 	})
 	if err != nil {
 		return err
 	}
 
+	if tuningConf.Mac != "" {
+		updateResultMac(tuningConf.PrevResult, args.IfName, tuningConf.Mac)
+	}
+
 	return types.PrintResult(tuningConf.PrevResult, tuningConf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	// TODO: the settings are not reverted to the previous values. Reverting the
-	// settings is not useful when the whole container goes away but it could be
-	// useful in scenarios where plugins are added and removed at runtime.
+	tuningConf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	path := statePath(tuningConf.DataDir, tuningConf.Name, args.ContainerID)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Nothing was changed, or DEL already ran
+		return nil
+	}
+	state, err := loadState(path)
+	if err != nil {
+		return err
+	}
+
+	// Restoring is pointless if the container is already gone
+	if args.Netns != "" {
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return restoreOriginals(args.IfName, state)
+		})
+		if err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok {
+				return err
+			}
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove tuning state: %v", err)
+	}
 	return nil
 }
 
+// restoreOriginals writes back the values recorded by ADD. It must be called
+// in the network namespace of the container.
+func restoreOriginals(ifName string, state *tuningState) error {
+	for key, value := range state.SysCtl {
+		fileName, err := sysctlPath(key)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fileName, []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to restore sysctl %q: %v", key, err)
+		}
+	}
+
+	if state.Link.isEmpty() && len(state.Ethtool) == 0 {
+		return nil
+	}
+	if _, err := netlink.LinkByName(ifName); err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			// The interface was deleted before us
+			return nil
+		}
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if err := changeLinkAttrs(ifName, &state.Link); err != nil {
+		return err
+	}
+	return setEthtoolFeatures(ifName, state.Ethtool)
+}
+
 func main() {
 	// TODO: implement plugin version
 	skel.PluginMain(cmdAdd, cmdGet, cmdDel, version.All, "TODO")
@@ -15,6 +15,12 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -28,11 +34,17 @@ import (
 
 var _ = Describe("tuning plugin", func() {
 	var originalNS ns.NetNS
+	var origDataDir string
 	const IFNAME string = "dummy0"
 
 	BeforeEach(func() {
-		// Create a new NetNS so we don't modify the host
+		// Keep the state files out of the host's data dir
 		var err error
+		origDataDir = defaultDataDir
+		defaultDataDir, err = ioutil.TempDir("", "tuning-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// Create a new NetNS so we don't modify the host
 		originalNS, err = testutils.NewNS()
 		Expect(err).NotTo(HaveOccurred())
 
@@ -54,6 +66,8 @@ var _ = Describe("tuning plugin", func() {
 
 	AfterEach(func() {
 		Expect(originalNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(defaultDataDir)).To(Succeed())
+		defaultDataDir = origDataDir
 	})
 
 	It("passes prevResult through unchanged", func() {
@@ -109,4 +123,376 @@ var _ = Describe("tuning plugin", func() {
 		})
 		Expect(err).NotTo(HaveOccurred())
 	})
+
+	It("configures the link attributes and updates the mac in prevResult", func() {
+		conf := []byte(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"mac": "c2:11:22:33:44:55",
+	"mtu": 1454,
+	"promisc": true,
+	"allmulti": true,
+	"txQLen": 20000,
+	"prevResult": {
+		"interfaces": [
+			{"name": "dummy0", "sandbox":"netns"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 0
+			}
+		]
+	}
+}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces[0].Mac).To(Equal("c2:11:22:33:44:55"))
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal("c2:11:22:33:44:55"))
+			Expect(link.Attrs().MTU).To(Equal(1454))
+			Expect(link.Attrs().Promisc).To(Equal(1))
+			Expect(link.Attrs().RawFlags & syscall.IFF_ALLMULTI).NotTo(BeZero())
+			Expect(link.Attrs().TxQLen).To(Equal(20000))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("prefers the link attributes of the runtime config", func() {
+		conf := []byte(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"mac": "c2:11:22:33:44:55",
+	"promisc": true,
+	"runtimeConfig": {
+		"mac": "c2:11:22:33:44:66",
+		"promisc": false
+	},
+	"prevResult": {
+		"interfaces": [
+			{"name": "dummy0", "sandbox":"netns"}
+		],
+		"ips": []
+	}
+}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces[0].Mac).To(Equal("c2:11:22:33:44:66"))
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal("c2:11:22:33:44:66"))
+			Expect(link.Attrs().Promisc).To(Equal(0))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects an invalid mac", func() {
+		_, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"mac": "c2:11:22"
+}`))
+		Expect(err).To(MatchError(HavePrefix(`invalid mac "c2:11:22"`)))
+	})
+
+	It("restores the original values on DEL", func() {
+		dataDir, err := ioutil.TempDir("", "tuning-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		conf := []byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"dataDir": "%s",
+	"sysctl": {
+		"net.ipv4.conf.all.log_martians": "1"
+	},
+	"mac": "c2:11:22:33:44:55",
+	"mtu": 1454,
+	"promisc": true,
+	"prevResult": {
+		"interfaces": [
+			{"name": "dummy0", "sandbox":"netns"}
+		],
+		"ips": []
+	}
+}`, dataDir))
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			origMac := link.Attrs().HardwareAddr.String()
+			origMtu := link.Attrs().MTU
+			origMartians, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/all/log_martians")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			statePath := filepath.Join(dataDir, "test", "dummy.json")
+			Expect(statePath).To(BeAnExistingFile())
+
+			link, err = netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal("c2:11:22:33:44:55"))
+
+			// A second ADD must not record the values it set as the originals
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(statePath).NotTo(BeAnExistingFile())
+
+			link, err = netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal(origMac))
+			Expect(link.Attrs().MTU).To(Equal(origMtu))
+			Expect(link.Attrs().Promisc).To(Equal(0))
+
+			martians, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/all/log_martians")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(martians).To(Equal(origMartians))
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets ethtool features and restores them on DEL", func() {
+		conf := []byte(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"ethtool": {
+		"features": {
+			"tx-tcp-segmentation": false
+		}
+	},
+	"prevResult": {
+		"interfaces": [
+			{"name": "dummy0", "sandbox":"netns"}
+		],
+		"ips": []
+	}
+}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			names := map[string]bool{"tx-tcp-segmentation": true}
+			orig, err := getEthtoolFeatures(IFNAME, names)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(orig["tx-tcp-segmentation"]).To(BeTrue())
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			features, err := getEthtoolFeatures(IFNAME, names)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(features["tx-tcp-segmentation"]).To(BeFalse())
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			features, err = getEthtoolFeatures(IFNAME, names)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(features["tx-tcp-segmentation"]).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports unsupported ethtool features", func() {
+		conf := []byte(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"ethtool": {
+		"features": {
+			"no-such-feature": false
+		}
+	}
+}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(`ethtool feature "no-such-feature" is not supported by "dummy0"`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("expands IFNAME in sysctl keys, including interface names with dots", func() {
+		const vlanIfName = "dummy0.100"
+		conf := []byte(`{
+	"name": "test",
+	"type": "tuning",
+	"cniVersion": "0.3.1",
+	"sysctl": {
+		"net.ipv4.conf.IFNAME.log_martians": "1",
+		"net/ipv4/conf/IFNAME/accept_redirects": "0"
+	},
+	"prevResult": {
+		"interfaces": [
+			{"name": "dummy0.100", "sandbox":"netns"}
+		],
+		"ips": []
+	}
+}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      vlanIfName,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: vlanIfName,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			martians, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/dummy0.100/log_martians")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(martians)).To(Equal("1\n"))
+			redirects, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/dummy0.100/accept_redirects")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(redirects)).To(Equal("0\n"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("sysctl keys", func() {
+	expand := func(key, ifName string) string {
+		k, err := expandSysctlKey(key, ifName)
+		Expect(err).NotTo(HaveOccurred())
+		return k
+	}
+
+	It("expands the keys for the interface", func() {
+		Expect(expand("net.ipv4.conf.IFNAME.accept_ra", "eth0")).To(Equal("net/ipv4/conf/eth0/accept_ra"))
+		Expect(expand("net.ipv4.conf.IFNAME.accept_ra", "eth0.100")).To(Equal("net/ipv4/conf/eth0.100/accept_ra"))
+		Expect(expand("net/ipv4/conf/eth0.100/accept_ra", "eth0")).To(Equal("net/ipv4/conf/eth0.100/accept_ra"))
+		Expect(expand("net.core.somaxconn", "eth0")).To(Equal("net/core/somaxconn"))
+		// Only whole components are replaced
+		Expect(expand("net.ipv4.conf.IFNAMEX.accept_ra", "eth0")).To(Equal("net/ipv4/conf/IFNAMEX/accept_ra"))
+	})
+
+	It("rejects keys with empty, . or .. components", func() {
+		for _, key := range []string{
+			"net/ipv4/conf/IFNAME/../../ip_forward",
+			"net/ipv4/./ip_forward",
+			"net/ipv4//ip_forward",
+			"net.ipv4..ip_forward",
+		} {
+			_, err := expandSysctlKey(key, "eth0")
+			Expect(err).To(MatchError(HavePrefix("invalid sysctl key")), key)
+		}
+	})
+
+	It("rejects keys set more than once", func() {
+		_, err := expandSysctls(map[string]string{
+			"net.ipv4.conf.IFNAME.accept_ra": "0",
+			"net/ipv4/conf/eth0/accept_ra":   "1",
+		}, "eth0")
+		Expect(err).To(MatchError(`sysctl key "net/ipv4/conf/eth0/accept_ra" is set more than once`))
+	})
 })